@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"gopkg.in/yaml.v3"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CSVMapping says how the columns of a CMDB export map to solutions, resources and attributes
+type CSVMapping struct {
+	Columns       CSVColumns                 `yaml:"columns"`
+	Relationships CSVRelationships           `yaml:"relationships"`
+	Classes       map[string]CSVClassMapping `yaml:"classes"`
+}
+
+// CSVColumns are the columns of the CI export which identify each CI, the id defaults to the name, and if there is a
+// solution column then a solution is created for each of its values
+type CSVColumns struct {
+	Class    string `yaml:"class"`
+	Name     string `yaml:"name"`
+	ID       string `yaml:"id"`
+	Solution string `yaml:"solution"`
+}
+
+// CSVRelationships are the columns of the relationship export, the parent depends on the child.  If include is given
+// then only relationships with one of those types are imported.
+type CSVRelationships struct {
+	Parent  string   `yaml:"parent"`
+	Child   string   `yaml:"child"`
+	Type    string   `yaml:"type"`
+	Include []string `yaml:"include"`
+}
+
+// CSVClassMapping maps a CI class to a resource type, attributes maps attribute paths (e.g. sla.rto or tags.owner) to
+// columns, and values sets attributes to fixed values for every CI of the class
+type CSVClassMapping struct {
+	Type       string            `yaml:"type"`
+	Attributes map[string]string `yaml:"attributes"`
+	Values     map[string]string `yaml:"values"`
+}
+
+// LoadCSVMapping reads a mapping file and fills in the default column names
+func LoadCSVMapping(file string) (CSVMapping, error) {
+	var mapping CSVMapping
+	f, err := os.Open(file)
+	if err != nil {
+		return mapping, err
+	}
+	defer f.Close()
+
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&mapping); err != nil {
+		return mapping, fmt.Errorf("cannot read mapping %s: %v", file, err)
+	}
+
+	if mapping.Columns.Class == "" {
+		mapping.Columns.Class = "class"
+	}
+	if mapping.Columns.Name == "" {
+		mapping.Columns.Name = "name"
+	}
+	if mapping.Columns.ID == "" {
+		mapping.Columns.ID = mapping.Columns.Name
+	}
+	if mapping.Relationships.Parent == "" {
+		mapping.Relationships.Parent = "parent"
+	}
+	if mapping.Relationships.Child == "" {
+		mapping.Relationships.Child = "child"
+	}
+	if len(mapping.Classes) == 0 {
+		return mapping, fmt.Errorf("mapping %s does not map any CI classes", file)
+	}
+	for class, classMapping := range mapping.Classes {
+		if classMapping.Type == "" {
+			return mapping, fmt.Errorf("CI class '%s' is not mapped to a resource type", class)
+		}
+	}
+	return mapping, nil
+}
+
+// csvTable is a CSV file which has been read into memory, with the line each row started on
+type csvTable struct {
+	filename string
+	columns  map[string]int
+	rows     [][]string
+	ranges   []hcl.Range
+	file     *hcl.File
+}
+
+// readCSV reads a CSV file with a header row
+func readCSV(filename string) (*csvTable, error) {
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := csv.NewReader(bytes.NewReader(src))
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("%s is empty", filename)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the file is kept so diagnostics can show the row
+	table := &csvTable{filename: filename, columns: make(map[string]int), file: &hcl.File{Bytes: src}}
+	for i, column := range header {
+		table.columns[strings.TrimSpace(strings.TrimPrefix(column, "\ufeff"))] = i
+	}
+	for {
+		start := int(reader.InputOffset())
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		end := strings.TrimRight(string(src[start:reader.InputOffset()]), "\r\n")
+		table.rows = append(table.rows, row)
+		table.ranges = append(table.ranges, hcl.Range{
+			Filename: filename,
+			Start:    hcl.Pos{Line: line, Column: 1, Byte: start},
+			End:      hcl.Pos{Line: line + strings.Count(end, "\n"), Column: len(end) - strings.LastIndex(end, "\n"), Byte: start + len(end)},
+		})
+	}
+	return table, nil
+}
+
+// requireColumns checks the table has all the columns the mapping uses
+func (t *csvTable) requireColumns(columns ...string) error {
+	for _, column := range columns {
+		if column == "" {
+			continue
+		}
+		if _, present := t.columns[column]; !present {
+			return fmt.Errorf("%s does not have a '%s' column", t.filename, column)
+		}
+	}
+	return nil
+}
+
+// value returns the value in a column of a row, rows which are too short are treated as empty
+func (t *csvTable) value(row int, column string) string {
+	i, present := t.columns[column]
+	if !present || i >= len(t.rows[row]) {
+		return ""
+	}
+	return strings.TrimSpace(t.rows[row][i])
+}
+
+// subject returns the range of a row, for diagnostics
+func (t *csvTable) subject(row int) hcl.Range {
+	return t.ranges[row]
+}
+
+// importedSolution is a solution built from a CMDB export
+type importedSolution struct {
+	solution  Solution
+	resources []Resource
+}
+
+// ImportCSV builds solutions from a CI export and an optional relationship export.  Rows which don't fit the mapping
+// or the spec are reported as warnings and left out.
+func ImportCSV(mapping CSVMapping, cis *csvTable, relationships *csvTable, defaultSolution Solution, typemap map[string]map[string]string, specs map[string]map[string]AttributeSpec) ([]importedSolution, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+	importers := make(map[string]*importer)
+	var solutionNames []string
+	ciSolution := make(map[string]string)
+
+	for row := range cis.rows {
+		subject := cis.subject(row)
+		class := cis.value(row, mapping.Columns.Class)
+		id := cis.value(row, mapping.Columns.ID)
+		name := cis.value(row, mapping.Columns.Name)
+		if id == "" || name == "" {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagWarning,
+				Summary:  "Missing CI name",
+				Detail:   fmt.Sprintf("The row does not have a value for '%s' or '%s', it is ignored.", mapping.Columns.ID, mapping.Columns.Name),
+				Subject:  subject.Ptr(),
+			})
+			continue
+		}
+		classMapping, present := mapping.Classes[class]
+		if !present {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagWarning,
+				Summary:  "Unmapped CI class",
+				Detail:   fmt.Sprintf("%s has the CI class \"%s\", which is not in the mapping, it is ignored.", id, class),
+				Subject:  subject.Ptr(),
+			})
+			continue
+		}
+
+		solutionName := defaultSolution.solutionName
+		if mapping.Columns.Solution != "" {
+			solutionName = cis.value(row, mapping.Columns.Solution)
+			if solutionName == "" {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagWarning,
+					Summary:  "Missing solution",
+					Detail:   fmt.Sprintf("%s does not have a value for '%s', it is ignored.", id, mapping.Columns.Solution),
+					Subject:  subject.Ptr(),
+				})
+				continue
+			}
+		}
+		im, present := importers[solutionName]
+		if !present {
+			im = newImporter(typemap, specs)
+			importers[solutionName] = im
+			solutionNames = append(solutionNames, solutionName)
+		}
+		if !im.AddResource(id, classMapping.Type, name, subject) {
+			continue
+		}
+		ciSolution[id] = solutionName
+
+		// fixed values first, so they can be overridden by columns
+		for _, path := range sortedKeys(classMapping.Values) {
+			im.SetAttribute(id, path, classMapping.Values[path], subject)
+		}
+		for _, path := range sortedKeys(classMapping.Attributes) {
+			column := classMapping.Attributes[path]
+			if _, present := cis.columns[column]; !present {
+				im.warn("Unknown column", fmt.Sprintf("%s is mapped from the column '%s', which is not in %s.", path, column, cis.filename), subject)
+				continue
+			}
+			im.SetAttribute(id, path, cis.value(row, column), subject)
+		}
+	}
+
+	if relationships != nil {
+		for row := range relationships.rows {
+			subject := relationships.subject(row)
+			if mapping.Relationships.Type != "" && len(mapping.Relationships.Include) > 0 && !containsString(mapping.Relationships.Include, relationships.value(row, mapping.Relationships.Type)) {
+				continue
+			}
+			parent := relationships.value(row, mapping.Relationships.Parent)
+			child := relationships.value(row, mapping.Relationships.Child)
+			parentSolution, parentPresent := ciSolution[parent]
+			childSolution, childPresent := ciSolution[child]
+			if parentPresent && childPresent && parentSolution != childSolution {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagWarning,
+					Summary:  "Relationship between solutions",
+					Detail:   fmt.Sprintf("The relationship from %s to %s is ignored, they are in different solutions (%s and %s).", parent, child, parentSolution, childSolution),
+					Subject:  subject.Ptr(),
+				})
+				continue
+			}
+			if !parentPresent {
+				parentSolution = childSolution
+			}
+			im, present := importers[parentSolution]
+			if !present {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagWarning,
+					Summary:  "Unknown relationship",
+					Detail:   fmt.Sprintf("The relationship from %s to %s is ignored, neither has been imported.", parent, child),
+					Subject:  subject.Ptr(),
+				})
+				continue
+			}
+			im.AddDependency(parent, child, subject)
+		}
+	}
+
+	var solutions []importedSolution
+	for _, solutionName := range solutionNames {
+		resources, diagnostics := importers[solutionName].Resources()
+		diags = append(diags, diagnostics...)
+		if len(resources) == 0 {
+			continue
+		}
+		solution := defaultSolution
+		solution.solutionName = solutionName
+		solutions = append(solutions, importedSolution{solution: solution, resources: resources})
+	}
+	sortDiagnostics(diags)
+	return solutions, diags
+}
+
+// sortedKeys returns the keys of a map in order, so imports are repeatable
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writeImportedSolutions writes each solution to its own file in the directory, named after the solution
+func writeImportedSolutions(directory string, solutions []importedSolution, typemap map[string]map[string]string) error {
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return err
+	}
+	written := make(map[string]bool)
+	for _, imported := range solutions {
+		filename := filepath.Join(directory, resourceIdentifier(imported.solution.solutionName)+".hcl")
+		if written[filename] {
+			return fmt.Errorf("more than one solution would be written to %s", filename)
+		}
+		written[filename] = true
+		log.WithFields(log.Fields{
+			"solutionName": imported.solution.solutionName,
+			"file":         filename,
+			"count":        len(imported.resources),
+		}).Info("Writing solution")
+		src, err := WriteSolution(imported.resources, imported.solution, typemap)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filename, src, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importCSVCommand imports solutions from CMDB CSV exports, and either matches them or writes them out as HCL
+func importCSVCommand(args []string) {
+	flags := flag.NewFlagSet("design-as-code import-csv", flag.ExitOnError)
+	var options reportOptions
+	options.addFlags(flags)
+	mappingFile := flags.String("mapping", "cmdb-mapping.yml", "Path to the file which maps CI classes and columns to resource types and attributes.")
+	cisFile := flags.String("cis", "", "Path to the CSV export of configuration items.")
+	relationshipsFile := flags.String("relationships", "", "Path to the CSV export of relationships between configuration items.")
+	solutionName := flags.String("solution-name", "", "The name of the solution, if the mapping does not have a solution column. (default the name of the CI export)")
+	solutionNumber := flags.String("solution-number", "", "The number of the solution.")
+	outDirectory := flags.String("out", "", "Write each solution as HCL to this directory, instead of matching it.")
+	flags.Parse(args)
+
+	options.setLogLevel()
+
+	if *cisFile == "" {
+		log.Fatal("The CSV export of configuration items (cis) is required")
+	}
+
+	_, typemap, specs, _ := loadSchema()
+
+	mapping, err := LoadCSVMapping(*mappingFile)
+	if err != nil {
+		log.WithError(err).Fatal("Cannot continue")
+	}
+
+	cis, err := readCSV(*cisFile)
+	if err == nil {
+		err = cis.requireColumns(mapping.Columns.Class, mapping.Columns.Name, mapping.Columns.ID, mapping.Columns.Solution)
+	}
+	if err != nil {
+		log.WithError(err).Fatal("Cannot read configuration items")
+	}
+
+	var relationships *csvTable
+	if *relationshipsFile != "" {
+		relationships, err = readCSV(*relationshipsFile)
+		if err == nil {
+			err = relationships.requireColumns(mapping.Relationships.Parent, mapping.Relationships.Child, mapping.Relationships.Type)
+		}
+		if err != nil {
+			log.WithError(err).Fatal("Cannot read relationships")
+		}
+	}
+
+	defaultSolution := Solution{solutionName: *solutionName, solutionNumber: *solutionNumber}
+	if defaultSolution.solutionName == "" {
+		defaultSolution.solutionName = strings.TrimSuffix(filepath.Base(*cisFile), filepath.Ext(*cisFile))
+	}
+
+	solutions, diags := ImportCSV(mapping, cis, relationships, defaultSolution, typemap, specs)
+	files := map[string]*hcl.File{cis.filename: cis.file}
+	if relationships != nil {
+		files[relationships.filename] = relationships.file
+	}
+	exitOnImportErrors(diags, files)
+	log.WithFields(log.Fields{
+		"solutions": len(solutions),
+	}).Info("Imported solutions")
+
+	if *outDirectory != "" {
+		if err := writeImportedSolutions(*outDirectory, solutions, typemap); err != nil {
+			log.WithError(err).Fatal("Error writing solutions")
+		}
+		return
+	}
+
+	patterns := loadPatterns(options.patternsLibraryFile)
+	var reports []solutionReport
+	for _, imported := range solutions {
+		reports = append(reports, reportSolution(imported.resources, imported.solution, patterns, typemap, options))
+	}
+	writeReports(options, reports)
+}
+
+// exitOnImportErrors prints the problems found by an import, the files are used to show the source of each problem,
+// and stops if any of them are errors
+func exitOnImportErrors(diags hcl.Diagnostics, files map[string]*hcl.File) {
+	if len(diags) == 0 {
+		return
+	}
+	wr := hcl.NewDiagnosticTextWriter(os.Stderr, files, 78, true)
+	wr.WriteDiagnostics(diags)
+	if diags.HasErrors() {
+		log.WithError(errors.New(diags.Error())).Fatal("Unrecoverable error")
+	}
+	log.WithFields(log.Fields{
+		"warnings": len(diags),
+	}).Warn("Some records were not imported")
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/hashicorp/hcl/v2"
 	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/hashicorp/hcl/v2/hclparse"
 	"github.com/zclconf/go-cty/cty"
 
 	log "github.com/sirupsen/logrus"
@@ -12,11 +16,23 @@ type Resource struct {
 	resourceType       string
 	resourceName       string
 	resourceAttributes map[string]interface{}
+	resourceLinks      []Relationship
+	resourceModule     string
+	resourceRange      hcl.Range
+}
+
+// Relationship is a typed link from one resource to another, e.g. a server reading from a NAS over NFS
+type Relationship struct {
+	source                 string
+	target                 string
+	targetType             string
+	relationshipAttributes map[string]interface{}
 }
 
 type Solution struct {
-	solutionName   string
-	solutionNumber string
+	solutionName     string
+	solutionNumber   string
+	solutionMetadata map[string]interface{}
 }
 
 func ExpressionToValue(expr hcl.Expression, ctx *hcl.EvalContext, variableName string, schema map[string]string) (interface{}, hcl.Diagnostics) {
@@ -28,11 +44,21 @@ func ExpressionToValue(expr hcl.Expression, ctx *hcl.EvalContext, variableName s
 	// if this is a depends_on, we need to handle it seperately
 	if variableName == "depends_on" {
 		log.Trace("This is depends_on, so a list of strings")
-		var out []string
-		diag := gohcl.DecodeExpression(expr, ctx, &out)
+		val, diag := expr.Value(ctx)
 		if diag != nil && diag.HasErrors() {
 			return nil, diag
 		}
+		out, err := flattenAddresses(val)
+		if err != nil {
+			return nil, hcl.Diagnostics{
+				{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid depends_on",
+					Detail:   fmt.Sprintf("The depends_on attribute must be a list of resources: %v.", err),
+					Subject:  expr.Range().Ptr(),
+				},
+			}
+		}
 		log.WithFields(log.Fields{
 			"variableName": variableName,
 			"value":        out,
@@ -74,6 +100,61 @@ func ExpressionToValue(expr hcl.Expression, ctx *hcl.EvalContext, variableName s
 			"value":        out,
 		}).Trace("Got an int")
 		return out, nil
+	case "float":
+		var out float64
+		diag := gohcl.DecodeExpression(expr, ctx, &out)
+		if diag != nil && diag.HasErrors() {
+			return nil, diag
+		}
+		log.WithFields(log.Fields{
+			"variableName": variableName,
+			"value":        out,
+		}).Trace("Got a float")
+		return out, nil
+	case "enum":
+		var out string
+		diag := gohcl.DecodeExpression(expr, ctx, &out)
+		if diag != nil && diag.HasErrors() {
+			return nil, diag
+		}
+		log.WithFields(log.Fields{
+			"variableName": variableName,
+			"value":        out,
+		}).Trace("Got an enum")
+		return out, nil
+	case "list(string)":
+		var out []string
+		diag := gohcl.DecodeExpression(expr, ctx, &out)
+		if diag != nil && diag.HasErrors() {
+			return nil, diag
+		}
+		log.WithFields(log.Fields{
+			"variableName": variableName,
+			"value":        out,
+		}).Trace("Got a list of strings")
+		return out, nil
+	case "list(int)":
+		var out []int
+		diag := gohcl.DecodeExpression(expr, ctx, &out)
+		if diag != nil && diag.HasErrors() {
+			return nil, diag
+		}
+		log.WithFields(log.Fields{
+			"variableName": variableName,
+			"value":        out,
+		}).Trace("Got a list of ints")
+		return out, nil
+	case "map(string)":
+		var out map[string]string
+		diag := gohcl.DecodeExpression(expr, ctx, &out)
+		if diag != nil && diag.HasErrors() {
+			return nil, diag
+		}
+		log.WithFields(log.Fields{
+			"variableName": variableName,
+			"value":        out,
+		}).Trace("Got a map of strings")
+		return out, nil
 	default:
 		log.WithFields(log.Fields{
 			"variableName": variableName,
@@ -82,68 +163,244 @@ func ExpressionToValue(expr hcl.Expression, ctx *hcl.EvalContext, variableName s
 	}
 }
 
-func DecodeBody(body *hcl.BodyContent, resourceType string, schemas map[string]hcl.BodySchema, typemap map[string]map[string]string) ([]Resource, Solution, hcl.Diagnostics) {
+// ValidateValue checks a decoded value against the constraints in the spec for the attribute
+func ValidateValue(attribute *hcl.Attribute, value interface{}, spec AttributeSpec) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+	invalid := func(summary string, detail string) {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  summary,
+			Detail:   detail,
+			Subject:  attribute.Expr.Range().Ptr(),
+		})
+	}
 
-	var resources []Resource
-	var solution Solution
+	if spec.Type == "enum" {
+		allowed := false
+		for _, option := range spec.Values {
+			if value.(string) == option {
+				allowed = true
+			}
+		}
+		if !allowed {
+			invalid("Invalid value for enum", fmt.Sprintf("The value \"%s\" is not allowed for %s, expecting one of: %s.", value, attribute.Name, strings.Join(spec.Values, ", ")))
+		}
+	}
 
-	variables := make(map[string][]string)
+	if spec.Min != nil || spec.Max != nil {
+		number, _ := toFloat(value)
+		if spec.Min != nil && number < *spec.Min {
+			invalid("Value is too small", fmt.Sprintf("The value of %s must be at least %v.", attribute.Name, *spec.Min))
+		}
+		if spec.Max != nil && number > *spec.Max {
+			invalid("Value is too large", fmt.Sprintf("The value of %s must be at most %v.", attribute.Name, *spec.Max))
+		}
+	}
 
-	// first pass to populate the parsing context
-	for _, block := range body.Blocks.OfType("resource") {
-		resourceType := block.Labels[0]
-		resourceName := block.Labels[1]
-		_, present := variables[resourceType]
-		if present {
-			variables[resourceType] = append(variables[resourceType], resourceName)
-		} else {
-			variables[resourceType] = append(make([]string, 0), resourceName)
+	if spec.Pattern != nil && !spec.Pattern.MatchString(value.(string)) {
+		invalid("Value does not match pattern", fmt.Sprintf("The value \"%s\" of %s must match the pattern %s.", value, attribute.Name, spec.Pattern.String()))
+	}
+
+	return diags
+}
+
+// DecodeBlock decodes the attributes of a resource or nested block, nested blocks become maps of their attributes
+// and defaults from the spec are filled in for any attributes which are not set
+func DecodeBlock(body hcl.Body, blockType string, ctx *hcl.EvalContext, schemas map[string]hcl.BodySchema, typemap map[string]map[string]string, specs map[string]map[string]AttributeSpec) (map[string]interface{}, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+	attributes := make(map[string]interface{})
+
+	schema := schemas[blockType]
+	contents, diagnostics := body.Content(&schema)
+	diags = append(diags, diagnostics...)
+	if contents == nil {
+		return attributes, diags
+	}
+
+	for _, attribute := range contents.Attributes {
+		val, diag := ExpressionToValue(attribute.Expr, ctx, attribute.Name, typemap[blockType])
+		if diag != nil && diag.HasErrors() {
+			diags = append(diags, diag...)
+			continue
 		}
+		log.WithFields(log.Fields{
+			"value": val,
+		}).Trace("Got a value back from ExpressionToValue")
+
+		diags = append(diags, ValidateValue(attribute, val, specs[blockType][attribute.Name])...)
+		attributes[attribute.Name] = val
 	}
 
-	objectMapForEval := make(map[string]cty.Value)
-	for resource, instances := range variables {
-		variableMap := make(map[string]cty.Value)
-		for _, instance := range instances {
-			variableMap[instance] = cty.StringVal(resource + "." + instance)
+	for _, block := range contents.Blocks {
+		// links are decoded by DecodeLinks
+		if block.Type == "link" {
+			continue
+		}
+		if _, present := attributes[block.Type]; present {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Duplicate block",
+				Detail:   fmt.Sprintf("Only one %s block is allowed here.", block.Type),
+				Subject:  block.DefRange.Ptr(),
+			})
+			continue
 		}
-		objectMapForEval[resource] = cty.ObjectVal(variableMap)
+		nested, diag := DecodeBlock(block.Body, block.Type, ctx, schemas, typemap, specs)
+		diags = append(diags, diag...)
+		attributes[block.Type] = nested
 	}
 
-	ctx := &hcl.EvalContext{
-		Variables: objectMapForEval,
+	for name, spec := range specs[blockType] {
+		if _, present := attributes[name]; present {
+			continue
+		}
+		if spec.Type == "block" && spec.Required {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Missing required block",
+				Detail:   fmt.Sprintf("A %s block is required here.", name),
+				Subject:  body.MissingItemRange().Ptr(),
+			})
+		}
+		if spec.Default != nil {
+			log.WithFields(log.Fields{
+				"variableName": name,
+				"value":        spec.Default,
+			}).Trace("Using default value")
+			attributes[name] = spec.Default
+		}
 	}
-	// second pass to get all the attributes
-	for _, block := range body.Blocks.OfType("resource") {
-		resourceType := block.Labels[0]
 
-		var resource Resource
-		attributes := make(map[string]interface{})
+	return attributes, diags
+}
 
-		resource.resourceName = block.Labels[1]
-		resource.resourceType = resourceType
+var linkTargetSchema = &hcl.BodySchema{
+	Attributes: []hcl.AttributeSchema{
+		{
+			Name:     "target",
+			Required: true,
+		},
+	},
+}
 
-		schema := schemas[resourceType]
-		contents, diagnostics := block.Body.Content(&schema)
-		if diagnostics != nil && diagnostics.HasErrors() {
-			return nil, solution, diagnostics
+// DecodeLinks decodes the link blocks of a resource into relationships, checking that each target is a resource
+// which exists in the solution.  A target which refers to an expanded resource creates a link to each instance.
+func DecodeLinks(blocks hcl.Blocks, source string, known map[string]bool, ctx *hcl.EvalContext, schemas map[string]hcl.BodySchema, typemap map[string]map[string]string, specs map[string]map[string]AttributeSpec) ([]Relationship, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+	var links []Relationship
+
+	for _, block := range blocks {
+		content, remain, diag := block.Body.PartialContent(linkTargetSchema)
+		diags = append(diags, diag...)
+		attributes, diag := DecodeBlock(remain, "link", ctx, schemas, typemap, specs)
+		diags = append(diags, diag...)
+		targetAttr, present := content.Attributes["target"]
+		if !present {
+			continue
+		}
+		val, diag := targetAttr.Expr.Value(ctx)
+		diags = append(diags, diag...)
+		if diag.HasErrors() {
+			continue
+		}
+		targets, err := flattenAddresses(val)
+		if err != nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid link target",
+				Detail:   fmt.Sprintf("The target of a link must be a resource: %v.", err),
+				Subject:  targetAttr.Expr.Range().Ptr(),
+			})
+			continue
 		}
 
-		for _, attribute := range contents.Attributes {
-			val, diag := ExpressionToValue(attribute.Expr, ctx, attribute.Name, typemap[resourceType])
-			if diag != nil && diag.HasErrors() {
-				return nil, solution, diag
+		for _, target := range targets {
+			if !known[target] || target == source {
+				detail := fmt.Sprintf("%s links to %s, which is not declared in the solution.", source, target)
+				if target == source {
+					detail = fmt.Sprintf("%s cannot link to itself.", source)
+				}
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid link target",
+					Detail:   detail,
+					Subject:  targetAttr.Expr.Range().Ptr(),
+				})
+				continue
 			}
+
 			log.WithFields(log.Fields{
-				"value": val,
-			}).Trace("Got a value back from ExpressionToValue")
+				"source": source,
+				"target": target,
+			}).Trace("Got a link")
 
-			attributes[attribute.Name] = val
+			links = append(links, Relationship{
+				source:                 source,
+				target:                 target,
+				targetType:             addressType(target),
+				relationshipAttributes: attributes,
+			})
 		}
+	}
+
+	return links, diags
+}
 
-		resource.resourceAttributes = attributes
+// DecodeOptions holds the settings which change how a solution is decoded
+type DecodeOptions struct {
+	// ExpandInstances treats count and for_each as meta-arguments which create multiple instances of a resource
+	ExpandInstances bool
+	// VariableFiles are the bodies of files which set values for variables, later files take precedence
+	VariableFiles []hcl.Body
+	// VariableValues are values for variables from the command line, these take precedence over the files
+	VariableValues map[string]string
+	// BaseDirectory is the directory containing the solution file, module sources are relative to this
+	BaseDirectory string
+	// Parser is used to read the files for modules, so they are in the same file cache as the solution
+	Parser *hclparse.Parser
+
+	// inputs are the values passed to a module, which set its variables
+	inputs map[string]moduleInput
+}
 
-		resources = append(resources, resource)
+// decodeState is shared by the solution and all the modules it uses while they are being decoded
+type decodeState struct {
+	schemas         map[string]hcl.BodySchema
+	typemap         map[string]map[string]string
+	specs           map[string]map[string]AttributeSpec
+	known           map[string]bool
+	undecoded       map[string]bool
+	dependsOnRanges map[string]hcl.Range
+	moduleSources   []string
+}
+
+func DecodeBody(body *hcl.BodyContent, resourceType string, schemas map[string]hcl.BodySchema, typemap map[string]map[string]string, specs map[string]map[string]AttributeSpec, options DecodeOptions) ([]Resource, Solution, hcl.Diagnostics) {
+
+	var solution Solution
+
+	state := &decodeState{
+		schemas:         schemas,
+		typemap:         typemap,
+		specs:           specs,
+		known:           make(map[string]bool),
+		undecoded:       make(map[string]bool),
+		dependsOnRanges: make(map[string]hcl.Range),
+	}
+
+	// variables, locals and functions can be used anywhere in the solution
+	baseCtx, diags := DecodeVariables(body, options)
+	if diags.HasErrors() {
+		sortDiagnostics(diags)
+		return nil, solution, diags
+	}
+
+	// the dependencies of the resources which did decode are checked even if there are other errors, so they are all
+	// reported at once
+	resources, ctx, diags := decodeResources(body, "", baseCtx, options, state)
+	diags = append(diags, ValidateDependencies(resources, state.dependsOnRanges, specs, state.undecoded)...)
+	if diags.HasErrors() {
+		sortDiagnostics(diags)
+		return nil, solution, diags
 	}
 
 	// get top level attributes
@@ -166,5 +423,196 @@ func DecodeBody(body *hcl.BodyContent, resourceType string, schemas map[string]h
 		}
 	}
 
+	metadata, diags := DecodeMetadata(body, ctx, schemas, typemap, specs)
+	if diags.HasErrors() {
+		sortDiagnostics(diags)
+		return nil, solution, diags
+	}
+	solution.solutionMetadata = metadata
+
 	return resources, solution, nil
 }
+
+// DecodeMetadata decodes the solution's metadata block, using the metadata entry in the spec.  If there is no
+// metadata block then the defaults are used, and any required attributes are reported as missing.
+func DecodeMetadata(body *hcl.BodyContent, ctx *hcl.EvalContext, schemas map[string]hcl.BodySchema, typemap map[string]map[string]string, specs map[string]map[string]AttributeSpec) (map[string]interface{}, hcl.Diagnostics) {
+	blocks := body.Blocks.OfType("metadata")
+	_, defined := schemas["metadata"]
+
+	if len(blocks) > 0 && !defined {
+		return nil, hcl.Diagnostics{
+			{
+				Severity: hcl.DiagError,
+				Summary:  "Unsupported block type",
+				Detail:   "Blocks of type \"metadata\" can only be used when metadata is defined in the spec.",
+				Subject:  blocks[0].DefRange.Ptr(),
+			},
+		}
+	}
+	if len(blocks) > 1 {
+		return nil, hcl.Diagnostics{
+			{
+				Severity: hcl.DiagError,
+				Summary:  "Duplicate block",
+				Detail:   "Only one metadata block is allowed.",
+				Subject:  blocks[1].DefRange.Ptr(),
+			},
+		}
+	}
+	if !defined {
+		return nil, nil
+	}
+
+	if len(blocks) == 0 {
+		metadata, diags := DecodeBlock(hcl.EmptyBody(), "metadata", ctx, schemas, typemap, specs)
+		for _, diag := range diags {
+			if diag.Subject == nil || diag.Subject.Filename == "" {
+				diag.Subject = body.MissingItemRange.Ptr()
+				diag.Detail = diag.Detail + " A metadata block is needed to set this."
+			}
+		}
+		return metadata, diags
+	}
+
+	log.Debug("Got metadata block")
+	return DecodeBlock(blocks[0].Body, "metadata", ctx, schemas, typemap, specs)
+}
+
+// decodeResources decodes the resources of the solution, or of a module when modulePath is set, along with the
+// resources of any modules it uses.  It returns the context used to decode the resources, which can refer to all of
+// them and to the outputs of the modules.
+func decodeResources(body *hcl.BodyContent, modulePath string, baseCtx *hcl.EvalContext, options DecodeOptions, state *decodeState) ([]Resource, *hcl.EvalContext, hcl.Diagnostics) {
+
+	var resources []Resource
+	var diags hcl.Diagnostics
+
+	variables := make(map[string]map[string]cty.Value)
+
+	// first pass to populate the parsing context, this also works out the instances for each block
+	blocks := body.Blocks.OfType("resource")
+	blockInstances := make([][]resourceInstance, len(blocks))
+	blockBodies := make([]hcl.Body, len(blocks))
+	for i, block := range blocks {
+		resourceType := block.Labels[0]
+		resourceName := block.Labels[1]
+
+		var instances []resourceInstance
+		var reference cty.Value
+		if options.ExpandInstances {
+			var diag hcl.Diagnostics
+			instances, reference, blockBodies[i], diag = expandInstances(block, modulePath, baseCtx)
+			diags = append(diags, diag...)
+			if diag.HasErrors() {
+				state.undecoded[makeAddress(modulePath, resourceType, resourceName)] = true
+				continue
+			}
+		} else {
+			instances, reference, blockBodies[i] = singleInstance(block, modulePath)
+		}
+		blockInstances[i] = instances
+
+		_, present := variables[resourceType]
+		if !present {
+			variables[resourceType] = make(map[string]cty.Value)
+		}
+		variables[resourceType][resourceName] = reference
+		for _, instance := range instances {
+			state.known[makeAddress(modulePath, resourceType, instance.name)] = true
+		}
+	}
+
+	objectMapForEval := make(map[string]cty.Value)
+	for resource, references := range variables {
+		objectMapForEval[resource] = cty.ObjectVal(references)
+	}
+
+	ctx := baseCtx.NewChild()
+	ctx.Variables = objectMapForEval
+
+	// modules can be given references to resources, and resources can refer to the outputs of modules, so the
+	// modules are decoded once the references are known and before the resources
+	moduleResources, outputs, diag := decodeModules(body.Blocks.OfType("module"), modulePath, ctx, options, state)
+	diags = append(diags, diag...)
+	resources = append(resources, moduleResources...)
+	if len(outputs) > 0 {
+		objectMapForEval["module"] = cty.ObjectVal(outputs)
+	}
+
+	// second pass to get all the attributes
+	nested := nestedTypes(state.typemap)
+	for i, block := range blocks {
+		resourceType := block.Labels[0]
+
+		if _, present := state.schemas[resourceType]; !present || reservedTypes[resourceType] {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Unknown resource type",
+				Detail:   fmt.Sprintf("The resource type \"%s\" is not defined in the spec.", resourceType),
+				Subject:  block.LabelRanges[0].Ptr(),
+			})
+			markUndecoded(state, modulePath, resourceType, blockInstances[i])
+			continue
+		}
+		if nested[resourceType] {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Unknown resource type",
+				Detail:   fmt.Sprintf("\"%s\" is a nested block in the spec, it can only be used inside another resource.", resourceType),
+				Subject:  block.LabelRanges[0].Ptr(),
+			})
+			markUndecoded(state, modulePath, resourceType, blockInstances[i])
+			continue
+		}
+
+		relationships, _, _ := block.Body.PartialContent(&hcl.BodySchema{
+			Attributes: []hcl.AttributeSchema{{Name: "depends_on"}},
+			Blocks:     []hcl.BlockHeaderSchema{{Type: "link"}},
+		})
+
+		for _, instance := range blockInstances[i] {
+			var resource Resource
+
+			resource.resourceName = instance.name
+			resource.resourceType = resourceType
+			resource.resourceModule = modulePath
+			resource.resourceRange = block.DefRange
+
+			// expressions in expanded resources can refer to count.index, each.key and each.value
+			instanceCtx := ctx
+			if instance.variables != nil {
+				instanceCtx = ctx.NewChild()
+				instanceCtx.Variables = instance.variables
+			}
+
+			attributes, diag := DecodeBlock(blockBodies[i], resourceType, instanceCtx, state.schemas, state.typemap, state.specs)
+			diags = append(diags, diag...)
+
+			// keep track of where depends_on is so problems with the dependencies can be reported against it
+			state.dependsOnRanges[resourceAddress(resource)] = block.DefRange
+			if attribute, present := relationships.Attributes["depends_on"]; present {
+				state.dependsOnRanges[resourceAddress(resource)] = attribute.Expr.Range()
+			}
+
+			// if the spec has no links then any link blocks have already been reported as unsupported
+			if _, present := state.schemas["link"]; present {
+				links, diag := DecodeLinks(relationships.Blocks, resourceAddress(resource), state.known, instanceCtx, state.schemas, state.typemap, state.specs)
+				diags = append(diags, diag...)
+				resource.resourceLinks = links
+			}
+
+			resource.resourceAttributes = attributes
+
+			resources = append(resources, resource)
+		}
+	}
+
+	return resources, ctx, diags
+}
+
+// markUndecoded records the instances of a resource block which could not be decoded, so depending on them is not
+// reported as depending on a resource which does not exist
+func markUndecoded(state *decodeState, modulePath string, resourceType string, instances []resourceInstance) {
+	for _, instance := range instances {
+		state.undecoded[makeAddress(modulePath, resourceType, instance.name)] = true
+	}
+}
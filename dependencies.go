@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// makeAddress builds the address used to refer to a resource in depends_on, e.g. server.ui, or module.web.server.ui
+// for a resource in a module
+func makeAddress(modulePath string, resourceType string, resourceName string) string {
+	if modulePath == "" {
+		return resourceType + "." + resourceName
+	}
+	return modulePath + "." + resourceType + "." + resourceName
+}
+
+// resourceAddress returns the address used to refer to a resource in depends_on
+func resourceAddress(resource Resource) string {
+	return makeAddress(resource.resourceModule, resource.resourceType, resource.resourceName)
+}
+
+// resourceKey returns the key used to identify a resource in the matcher and the output, e.g. server/ui, or
+// module.web/server/ui for a resource in a module
+func resourceKey(resource Resource) string {
+	key := resource.resourceType + "/" + resource.resourceName
+	if resource.resourceModule != "" {
+		key = resource.resourceModule + "/" + key
+	}
+	return key
+}
+
+// addressType returns the resource type from an address, skipping over any module path
+func addressType(address string) string {
+	parts := strings.Split(address, ".")
+	i := 0
+	for i+2 < len(parts) && parts[i] == "module" {
+		i = i + 2
+	}
+	return parts[i]
+}
+
+// resourceDependencies returns the addresses of the resources this resource depends on
+func resourceDependencies(resource Resource) []string {
+	dependencies, present := resource.resourceAttributes["depends_on"]
+	if !present {
+		return nil
+	}
+	return dependencies.([]string)
+}
+
+// ValidateDependencies checks that every depends_on refers to a resource which exists, is not a self reference, is to a
+// type the spec allows, and that there are no cycles in the dependency graph.  The ranges map holds the range of each
+// resource's depends_on attribute, keyed by resource address, so the diagnostics can point at it.  Dependencies on the
+// undecoded resources, which could not be decoded, are not checked.
+func ValidateDependencies(resources []Resource, ranges map[string]hcl.Range, specs map[string]map[string]AttributeSpec, undecoded map[string]bool) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+
+	byAddress := make(map[string]Resource)
+	for _, resource := range resources {
+		byAddress[resourceAddress(resource)] = resource
+	}
+
+	invalid := func(address string, summary string, detail string) {
+		subject := ranges[address]
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  summary,
+			Detail:   detail,
+			Subject:  &subject,
+		})
+	}
+
+	for _, resource := range resources {
+		address := resourceAddress(resource)
+		allowed, restricted := specs[resource.resourceType]["depends_on"]
+		for _, dependency := range resourceDependencies(resource) {
+			target, present := byAddress[dependency]
+			if !present && (undecoded[dependency] || undecoded[baseAddress(dependency)]) {
+				// the problem with the resource it depends on has already been reported
+				continue
+			}
+			if !present {
+				invalid(address, "Reference to undeclared resource", fmt.Sprintf("%s depends on %s, which is not declared in the solution.", address, dependency))
+				continue
+			}
+			if dependency == address {
+				invalid(address, "Self-referential dependency", fmt.Sprintf("%s cannot depend on itself.", address))
+				continue
+			}
+			if restricted && !containsString(allowed.Values, target.resourceType) {
+				invalid(address, "Dependency not allowed", fmt.Sprintf("A %s cannot depend on a %s (%s), the spec allows: %s.", resource.resourceType, target.resourceType, dependency, describeAllowed(allowed.Values)))
+			}
+		}
+	}
+
+	// only look for cycles if the edges themselves are valid
+	if diags.HasErrors() {
+		return diags
+	}
+
+	for _, cycle := range findCycles(resources) {
+		log.WithFields(log.Fields{
+			"cycle": cycle,
+		}).Debug("Found dependency cycle")
+		invalid(cycle[0], "Dependency cycle", fmt.Sprintf("The dependencies form a cycle: %s.", strings.Join(cycle, " -> ")))
+	}
+
+	return diags
+}
+
+// findCycles does a depth first search of the dependency graph and returns each cycle it finds as a list of resource
+// addresses, where the first address is repeated at the end
+func findCycles(resources []Resource) [][]string {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	edges := make(map[string][]string)
+	var addresses []string
+	for _, resource := range resources {
+		address := resourceAddress(resource)
+		addresses = append(addresses, address)
+		edges[address] = resourceDependencies(resource)
+	}
+	sort.Strings(addresses)
+
+	var cycles [][]string
+	state := make(map[string]int)
+	var path []string
+	var visit func(address string)
+	visit = func(address string) {
+		state[address] = visiting
+		path = append(path, address)
+		for _, dependency := range edges[address] {
+			switch state[dependency] {
+			case unvisited:
+				visit(dependency)
+			case visiting:
+				// the cycle is the part of the path from the first visit of this dependency
+				for i, step := range path {
+					if step == dependency {
+						cycle := append([]string{}, path[i:]...)
+						cycles = append(cycles, append(cycle, dependency))
+						break
+					}
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[address] = visited
+	}
+
+	for _, address := range addresses {
+		if state[address] == unvisited {
+			visit(address)
+		}
+	}
+
+	return cycles
+}
+
+// describeAllowed lists the allowed dependency types for a diagnostic
+func describeAllowed(allowed []string) string {
+	if len(allowed) == 0 {
+		return "no dependencies"
+	}
+	return strings.Join(allowed, ", ")
+}
+
+// containsString returns true if the list contains the value
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
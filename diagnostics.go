@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+)
+
+// diagnosticFormats are the formats diagnostics can be written in
+var diagnosticFormats = map[string]bool{
+	"text":  true,
+	"json":  true,
+	"sarif": true,
+}
+
+// nonIdentifier matches the characters which are replaced in rule ids
+var nonIdentifier = regexp.MustCompile(`[^a-z0-9]+`)
+
+// sarifSchema is the schema of the SARIF documents we write
+const sarifSchema = "https://json.schemastore.org/sarif-2.1.0.json"
+
+// jsonDiagnostics is the document written for the json format
+type jsonDiagnostics struct {
+	Valid        bool             `json:"valid"`
+	ErrorCount   int              `json:"error_count"`
+	WarningCount int              `json:"warning_count"`
+	Diagnostics  []jsonDiagnostic `json:"diagnostics"`
+}
+
+type jsonDiagnostic struct {
+	Severity string     `json:"severity"`
+	Summary  string     `json:"summary"`
+	Detail   string     `json:"detail,omitempty"`
+	Range    *jsonRange `json:"range,omitempty"`
+}
+
+type jsonRange struct {
+	Filename string  `json:"filename"`
+	Start    jsonPos `json:"start"`
+	End      jsonPos `json:"end"`
+}
+
+type jsonPos struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+	Byte   int `json:"byte"`
+}
+
+// sarifLog is the part of a SARIF 2.1.0 log we write, with a single run
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name  string      `json:"name"`
+	Rules []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations,omitempty"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           sarifRegion           `json:"region"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn"`
+	EndLine     int `json:"endLine"`
+	EndColumn   int `json:"endColumn"`
+}
+
+// WriteDiagnostics writes diagnostics in one of the diagnostic formats, the files are used to show the source in the
+// text format
+func WriteDiagnostics(w io.Writer, format string, diags hcl.Diagnostics, files map[string]*hcl.File) error {
+	switch format {
+	case "text":
+		wr := hcl.NewDiagnosticTextWriter(w, files, 78, true)
+		return wr.WriteDiagnostics(diags)
+	case "json":
+		return writeJSONDocument(w, diagnosticsToJSON(diags))
+	case "sarif":
+		return writeJSONDocument(w, diagnosticsToSARIF(diags))
+	}
+	return fmt.Errorf("unknown diagnostic format '%s'", format)
+}
+
+func writeJSONDocument(w io.Writer, document interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(document)
+}
+
+func diagnosticSeverity(diag *hcl.Diagnostic) string {
+	if diag.Severity == hcl.DiagError {
+		return "error"
+	}
+	return "warning"
+}
+
+func diagnosticsToJSON(diags hcl.Diagnostics) jsonDiagnostics {
+	document := jsonDiagnostics{
+		Valid:       !diags.HasErrors(),
+		Diagnostics: []jsonDiagnostic{},
+	}
+	for _, diag := range diags {
+		if diag.Severity == hcl.DiagError {
+			document.ErrorCount++
+		} else {
+			document.WarningCount++
+		}
+		d := jsonDiagnostic{
+			Severity: diagnosticSeverity(diag),
+			Summary:  diag.Summary,
+			Detail:   diag.Detail,
+		}
+		if diag.Subject != nil {
+			d.Range = &jsonRange{
+				Filename: diag.Subject.Filename,
+				Start:    jsonPos{diag.Subject.Start.Line, diag.Subject.Start.Column, diag.Subject.Start.Byte},
+				End:      jsonPos{diag.Subject.End.Line, diag.Subject.End.Column, diag.Subject.End.Byte},
+			}
+		}
+		document.Diagnostics = append(document.Diagnostics, d)
+	}
+	return document
+}
+
+// diagnosticsToSARIF converts diagnostics to a SARIF log, the rule of each diagnostic comes from its summary, so
+// annotations for the same kind of problem are grouped together
+func diagnosticsToSARIF(diags hcl.Diagnostics) sarifLog {
+	run := sarifRun{
+		Tool: sarifTool{
+			Driver: sarifDriver{Name: "design-as-code", Rules: []sarifRule{}},
+		},
+		Results: []sarifResult{},
+	}
+	var rules []string
+	summaries := make(map[string]string)
+	for _, diag := range diags {
+		ruleID := sarifRuleID(diag.Summary)
+		if !containsString(rules, ruleID) {
+			rules = append(rules, ruleID)
+			summaries[ruleID] = diag.Summary
+		}
+		message := diag.Summary
+		if diag.Detail != "" {
+			message = diag.Summary + ": " + diag.Detail
+		}
+		result := sarifResult{
+			RuleID:  ruleID,
+			Level:   diagnosticSeverity(diag),
+			Message: sarifMessage{Text: message},
+		}
+		if diag.Subject != nil {
+			result.Locations = []sarifLocation{{
+				PhysicalLocation: sarifPhysicalLocation{
+					ArtifactLocation: sarifArtifactLocation{URI: diag.Subject.Filename},
+					Region: sarifRegion{
+						StartLine:   diag.Subject.Start.Line,
+						StartColumn: diag.Subject.Start.Column,
+						EndLine:     diag.Subject.End.Line,
+						EndColumn:   diag.Subject.End.Column,
+					},
+				},
+			}}
+		}
+		run.Results = append(run.Results, result)
+	}
+	sort.Strings(rules)
+	for _, id := range rules {
+		run.Tool.Driver.Rules = append(run.Tool.Driver.Rules, sarifRule{ID: id, ShortDescription: sarifMessage{Text: summaries[id]}})
+	}
+	return sarifLog{Schema: sarifSchema, Version: "2.1.0", Runs: []sarifRun{run}}
+}
+
+// sarifRuleID turns the summary of a diagnostic into a rule id, e.g. Unknown resource type becomes unknown-resource-type
+func sarifRuleID(summary string) string {
+	return strings.Trim(nonIdentifier.ReplaceAllString(strings.ToLower(summary), "-"), "-")
+}
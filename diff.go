@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines shown around each change in a unified diff
+const diffContext = 3
+
+// diffLine is a line in a diff, the kind is ' ' for a line in both files, '-' for a line only in the old file, and
+// '+' for a line only in the new file
+type diffLine struct {
+	kind byte
+	text string
+}
+
+// UnifiedDiff returns the differences between two files in unified diff format, or an empty string if they are the same
+func UnifiedDiff(oldName string, newName string, oldSrc []byte, newSrc []byte) string {
+	if bytes.Equal(oldSrc, newSrc) {
+		return ""
+	}
+	lines := diffLines(splitLines(oldSrc), splitLines(newSrc))
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", oldName, newName)
+
+	// line numbers in each file, counting from 1, at the start of each line in the diff
+	oldLine := make([]int, len(lines)+1)
+	newLine := make([]int, len(lines)+1)
+	oldLine[0], newLine[0] = 1, 1
+	for i, line := range lines {
+		oldLine[i+1], newLine[i+1] = oldLine[i], newLine[i]
+		if line.kind != '+' {
+			oldLine[i+1]++
+		}
+		if line.kind != '-' {
+			newLine[i+1]++
+		}
+	}
+
+	for i := 0; i < len(lines); {
+		if lines[i].kind == ' ' {
+			i++
+			continue
+		}
+		// a hunk runs until there are more than two lots of context between changes
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for j := i; j < len(lines) && j-end <= 2*diffContext; j++ {
+			if lines[j].kind != ' ' {
+				end = j + 1
+			}
+		}
+		hunkEnd := end + diffContext
+		if hunkEnd > len(lines) {
+			hunkEnd = len(lines)
+		}
+
+		oldCount, newCount := oldLine[hunkEnd]-oldLine[start], newLine[hunkEnd]-newLine[start]
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(oldLine[start], oldCount), hunkRange(newLine[start], newCount))
+		for _, line := range lines[start:hunkEnd] {
+			fmt.Fprintf(&out, "%c%s\n", line.kind, line.text)
+		}
+		i = hunkEnd
+	}
+	return out.String()
+}
+
+// hunkRange formats the start and length of a hunk, an empty hunk starts at the line before it
+func hunkRange(start int, count int) string {
+	if count == 0 {
+		start--
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+func splitLines(src []byte) []string {
+	text := strings.TrimSuffix(string(src), "\n")
+	if text == "" {
+		return nil
+	}
+	return strings.Split(text, "\n")
+}
+
+// diffLines finds the shortest set of changes from the old lines to the new lines using the longest common
+// subsequence, lines which are the same at the start and end are skipped first to keep the table small
+func diffLines(oldLines []string, newLines []string) []diffLine {
+	prefix := 0
+	for prefix < len(oldLines) && prefix < len(newLines) && oldLines[prefix] == newLines[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(oldLines)-prefix && suffix < len(newLines)-prefix && oldLines[len(oldLines)-1-suffix] == newLines[len(newLines)-1-suffix] {
+		suffix++
+	}
+
+	var lines []diffLine
+	for _, line := range oldLines[:prefix] {
+		lines = append(lines, diffLine{' ', line})
+	}
+
+	a := oldLines[prefix : len(oldLines)-suffix]
+	b := newLines[prefix : len(newLines)-suffix]
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, diffLine{' ', a[i]})
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] > lcs[i+1][j]):
+			lines = append(lines, diffLine{'+', b[j]})
+			j++
+		default:
+			lines = append(lines, diffLine{'-', a[i]})
+			i++
+		}
+	}
+
+	for _, line := range oldLines[len(oldLines)-suffix:] {
+		lines = append(lines, diffLine{' ', line})
+	}
+	return lines
+}
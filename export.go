@@ -0,0 +1,406 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// exportColumns are the columns of the resources sheet and CSV before the attributes
+var exportColumns = []string{"solution_name", "solution_number", "resource", "resource_type", "resource_name", "module", "pattern", "target"}
+
+// exportSheet is a sheet of the workbook, a header and rows of cells
+type exportSheet struct {
+	name   string
+	header []string
+	rows   [][]interface{}
+}
+
+// attributeColumns returns the attributes of the resource types in the spec, in the order of their names.  Nested
+// block types are left out, as their attributes are part of the value of the block.
+func attributeColumns(typemap map[string]map[string]string) []string {
+	blockTypes := make(map[string]bool)
+	for _, attributes := range typemap {
+		for name, vtype := range attributes {
+			if vtype == "block" {
+				blockTypes[name] = true
+			}
+		}
+	}
+	var columns []string
+	for resourceType, attributes := range typemap {
+		if reservedTypes[resourceType] || blockTypes[resourceType] {
+			continue
+		}
+		for name := range attributes {
+			if name != "depends_on" && !containsString(columns, name) {
+				columns = append(columns, name)
+			}
+		}
+	}
+	sort.Strings(columns)
+	return columns
+}
+
+// exportValue converts a value for a cell, numbers and bools keep their types, lists are separated by commas and
+// blocks and maps are written as name = value
+func exportValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case int, float64, bool:
+		return v
+	case []ResultAttribute, map[string]string, nil:
+		return formatValue(v)
+	}
+	rv := reflect.ValueOf(value)
+	if rv.Kind() == reflect.Slice {
+		parts := make([]string, rv.Len())
+		for i := range parts {
+			parts[i] = fmt.Sprintf("%v", rv.Index(i).Interface())
+		}
+		return strings.Join(parts, ", ")
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// resourceSheet has a row for each resource, with the pattern the solver chose for it and a column for each attribute
+// in the spec
+func resourceSheet(reports []solutionReport) exportSheet {
+	typemap := make(map[string]map[string]string)
+	for _, report := range reports {
+		for resourceType, attributes := range report.typemap {
+			typemap[resourceType] = attributes
+		}
+	}
+	columns := attributeColumns(typemap)
+	sheet := exportSheet{name: "Resources", header: append([]string{}, exportColumns...)}
+	for _, column := range columns {
+		if containsString(exportColumns, column) {
+			column = "attribute_" + column
+		}
+		sheet.header = append(sheet.header, column)
+	}
+
+	for _, report := range reports {
+		targets := make(map[string]string)
+		for _, pattern := range report.result.Patterns {
+			targets[pattern.Name] = pattern.Target
+		}
+		for _, resource := range report.result.Resources {
+			var pattern string
+			if resource.Pattern != nil {
+				pattern = *resource.Pattern
+			}
+			row := []interface{}{
+				report.result.Solution.Name,
+				report.result.Solution.Number,
+				resource.Address,
+				resource.Type,
+				resource.Name,
+				resource.Module,
+				pattern,
+				targets[pattern],
+			}
+			for _, column := range columns {
+				var value interface{}
+				switch column {
+				case "description":
+					value = resource.Description
+				case "tags":
+					if len(resource.Tags) > 0 {
+						value = resource.Tags
+					}
+				default:
+					for _, attribute := range resource.Attributes {
+						if attribute.Name == column {
+							value = attribute.Value
+						}
+					}
+				}
+				row = append(row, exportValue(value))
+			}
+			sheet.rows = append(sheet.rows, row)
+		}
+	}
+	return sheet
+}
+
+// matchSheet has a row for each resource covered by a chosen pattern
+func matchSheet(reports []solutionReport) exportSheet {
+	sheet := exportSheet{
+		name:   "Matches",
+		header: []string{"solution_name", "solution_number", "pattern", "target", "description", "weight", "condition_count", "resource"},
+	}
+	for _, report := range reports {
+		for _, pattern := range report.result.Patterns {
+			for _, address := range pattern.Resources {
+				sheet.rows = append(sheet.rows, []interface{}{
+					report.result.Solution.Name,
+					report.result.Solution.Number,
+					pattern.Name,
+					pattern.Target,
+					pattern.Description,
+					pattern.Weight,
+					pattern.ConditionCount,
+					address,
+				})
+			}
+		}
+	}
+	return sheet
+}
+
+// unmatchedSheet has a row for each resource which is not covered by a chosen pattern
+func unmatchedSheet(reports []solutionReport) exportSheet {
+	sheet := exportSheet{
+		name:   "Unmatched",
+		header: []string{"solution_name", "solution_number", "resource", "resource_type", "resource_name", "module", "tags"},
+	}
+	for _, report := range reports {
+		for _, resource := range report.result.Resources {
+			if !containsString(report.result.Unmatched, resource.Address) {
+				continue
+			}
+			sheet.rows = append(sheet.rows, []interface{}{
+				report.result.Solution.Name,
+				report.result.Solution.Number,
+				resource.Address,
+				resource.Type,
+				resource.Name,
+				resource.Module,
+				formatValue(resource.Tags),
+			})
+		}
+	}
+	return sheet
+}
+
+// patternSummarySheet has a row for each pattern chosen for any of the solutions, with the number of solutions and
+// resources it was chosen for and the types of the resources
+func patternSummarySheet(reports []solutionReport) exportSheet {
+	type summary struct {
+		pattern   ResultPattern
+		solutions int
+		resources int
+		types     []string
+	}
+	summaries := make(map[string]*summary)
+	var names []string
+	for _, report := range reports {
+		types := make(map[string]string)
+		for _, resource := range report.result.Resources {
+			types[resource.Address] = resource.Type
+		}
+		for _, pattern := range report.result.Patterns {
+			s, present := summaries[pattern.Name]
+			if !present {
+				s = &summary{pattern: pattern}
+				summaries[pattern.Name] = s
+				names = append(names, pattern.Name)
+			}
+			s.solutions++
+			s.resources += len(pattern.Resources)
+			for _, address := range pattern.Resources {
+				if !containsString(s.types, types[address]) {
+					s.types = append(s.types, types[address])
+				}
+			}
+		}
+	}
+	sort.Strings(names)
+
+	sheet := exportSheet{
+		name:   "Patterns",
+		header: []string{"pattern", "target", "description", "weight", "solutions", "resources", "resource_types"},
+	}
+	for _, name := range names {
+		s := summaries[name]
+		sort.Strings(s.types)
+		sheet.rows = append(sheet.rows, []interface{}{
+			name,
+			s.pattern.Target,
+			s.pattern.Description,
+			s.pattern.Weight,
+			s.solutions,
+			s.resources,
+			strings.Join(s.types, ", "),
+		})
+	}
+	return sheet
+}
+
+// writeReportCSV writes the resources sheet as CSV
+func writeReportCSV(w io.Writer, reports []solutionReport) error {
+	sheet := resourceSheet(reports)
+	out := csv.NewWriter(w)
+	out.Write(sheet.header)
+	for _, row := range sheet.rows {
+		record := make([]string, len(row))
+		for i, value := range row {
+			record[i] = fmt.Sprintf("%v", value)
+		}
+		out.Write(record)
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// xlsxCell is a cell of a worksheet, strings are written inline so the workbook does not need a shared strings part
+type xlsxCell struct {
+	Ref       string  `xml:"r,attr"`
+	Type      string  `xml:"t,attr,omitempty"`
+	Style     int     `xml:"s,attr,omitempty"`
+	Value     *string `xml:"v,omitempty"`
+	InlineStr *struct {
+		Text string `xml:"t"`
+	} `xml:"is,omitempty"`
+}
+
+type xlsxRow struct {
+	Number int        `xml:"r,attr"`
+	Cells  []xlsxCell `xml:"c"`
+}
+
+type xlsxWorksheet struct {
+	XMLName   xml.Name `xml:"http://schemas.openxmlformats.org/spreadsheetml/2006/main worksheet"`
+	SheetData struct {
+		Rows []xlsxRow `xml:"row"`
+	} `xml:"sheetData"`
+	AutoFilter *struct {
+		Ref string `xml:"ref,attr"`
+	} `xml:"autoFilter,omitempty"`
+}
+
+// xlsxColumn returns the letters of a column, counting from 0, e.g. 0 is A and 26 is AA
+func xlsxColumn(i int) string {
+	name := ""
+	for i >= 0 {
+		name = string(rune('A'+i%26)) + name
+		i = i/26 - 1
+	}
+	return name
+}
+
+// xlsxMakeCell makes a cell for a value, the header is in bold
+func xlsxMakeCell(ref string, value interface{}, header bool) xlsxCell {
+	cell := xlsxCell{Ref: ref}
+	if header {
+		cell.Style = 1
+	}
+	var text string
+	switch v := value.(type) {
+	case int, float64:
+		text = fmt.Sprintf("%v", v)
+		cell.Value = &text
+		return cell
+	case bool:
+		text = "0"
+		if v {
+			text = "1"
+		}
+		cell.Type = "b"
+		cell.Value = &text
+		return cell
+	case string:
+		text = v
+	default:
+		text = fmt.Sprintf("%v", v)
+	}
+	cell.Type = "inlineStr"
+	cell.InlineStr = &struct {
+		Text string `xml:"t"`
+	}{Text: text}
+	return cell
+}
+
+// xlsxSheet converts a sheet to a worksheet, with a filter on the header
+func xlsxSheet(sheet exportSheet) xlsxWorksheet {
+	var ws xlsxWorksheet
+	header := xlsxRow{Number: 1}
+	for i, name := range sheet.header {
+		header.Cells = append(header.Cells, xlsxMakeCell(fmt.Sprintf("%s1", xlsxColumn(i)), name, true))
+	}
+	ws.SheetData.Rows = append(ws.SheetData.Rows, header)
+	for r, values := range sheet.rows {
+		row := xlsxRow{Number: r + 2}
+		for i, value := range values {
+			row.Cells = append(row.Cells, xlsxMakeCell(fmt.Sprintf("%s%d", xlsxColumn(i), r+2), value, false))
+		}
+		ws.SheetData.Rows = append(ws.SheetData.Rows, row)
+	}
+	ws.AutoFilter = &struct {
+		Ref string `xml:"ref,attr"`
+	}{Ref: fmt.Sprintf("A1:%s%d", xlsxColumn(len(sheet.header)-1), len(sheet.rows)+1)}
+	return ws
+}
+
+// xlsxParts are the parts of a workbook which do not depend on the sheets, the styles have a bold font for headers
+const (
+	xlsxRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`
+	xlsxStyles = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts><fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills><borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders><cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs><cellXfs count="2"><xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/><xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/></cellXfs></styleSheet>`
+)
+
+// writeWorkbook writes an Excel workbook with sheets for the resources, the matches, the unmatched resources and a
+// summary of the patterns
+func writeWorkbook(w io.Writer, reports []solutionReport) error {
+	sheets := []exportSheet{resourceSheet(reports), matchSheet(reports), unmatchedSheet(reports), patternSummarySheet(reports)}
+
+	var contentTypes, workbook, workbookRels strings.Builder
+	contentTypes.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n")
+	contentTypes.WriteString(`<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">`)
+	contentTypes.WriteString(`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>`)
+	contentTypes.WriteString(`<Default Extension="xml" ContentType="application/xml"/>`)
+	contentTypes.WriteString(`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>`)
+	contentTypes.WriteString(`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>`)
+	workbook.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n")
+	workbook.WriteString(`<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets>`)
+	workbookRels.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n")
+	workbookRels.WriteString(`<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">`)
+	for i, sheet := range sheets {
+		fmt.Fprintf(&contentTypes, `<Override PartName="/xl/worksheets/sheet%d.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`, i+1)
+		fmt.Fprintf(&workbook, `<sheet name="%s" sheetId="%d" r:id="rId%d"/>`, sheet.name, i+1, i+1)
+		fmt.Fprintf(&workbookRels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet%d.xml"/>`, i+1, i+1)
+	}
+	fmt.Fprintf(&workbookRels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>`, len(sheets)+1)
+	contentTypes.WriteString(`</Types>`)
+	workbook.WriteString(`</sheets></workbook>`)
+	workbookRels.WriteString(`</Relationships>`)
+
+	z := zip.NewWriter(w)
+	parts := []struct {
+		name    string
+		content string
+	}{
+		{"[Content_Types].xml", contentTypes.String()},
+		{"_rels/.rels", xlsxRels},
+		{"xl/workbook.xml", workbook.String()},
+		{"xl/_rels/workbook.xml.rels", workbookRels.String()},
+		{"xl/styles.xml", xlsxStyles},
+	}
+	for _, part := range parts {
+		f, err := z.Create(part.name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(f, part.content); err != nil {
+			return err
+		}
+	}
+	for i, sheet := range sheets {
+		f, err := z.Create(fmt.Sprintf("xl/worksheets/sheet%d.xml", i+1))
+		if err != nil {
+			return err
+		}
+		io.WriteString(f, xml.Header)
+		if err := xml.NewEncoder(f).Encode(xlsxSheet(sheet)); err != nil {
+			return err
+		}
+	}
+	return z.Close()
+}
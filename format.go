@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// FormatSource formats a solution, module or pattern file canonically.  As well as the layout and alignment done by
+// hclwrite, resource blocks are sorted by type and name, and depends_on lists are sorted.  Comments and everything
+// else in the file stay where they are.
+func FormatSource(src []byte, filename string) ([]byte, hcl.Diagnostics) {
+	file, diags := hclsyntax.ParseConfig(src, filename, hcl.InitialPos)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	src = sortResourceBlocks(src, file.Body.(*hclsyntax.Body))
+
+	writeFile, diags := hclwrite.ParseConfig(src, filename, hcl.InitialPos)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	sortDependsOn(writeFile.Body())
+
+	return hclwrite.Format(writeFile.Bytes()), nil
+}
+
+// sourceSegment is the source of a top level block, including any comments on the lines just before it
+type sourceSegment struct {
+	start int
+	end   int
+	key   string
+}
+
+// sortResourceBlocks moves the top level resource blocks so they are in type and name order, the other blocks and
+// attributes are not moved, so the resources just swap places with each other
+func sortResourceBlocks(src []byte, body *hclsyntax.Body) []byte {
+	var segments []sourceSegment
+	for _, block := range body.Blocks {
+		if block.Type != "resource" || len(block.Labels) != 2 {
+			continue
+		}
+		segments = append(segments, sourceSegment{
+			start: segmentStart(src, block.TypeRange.Start.Byte),
+			end:   lineEnd(src, block.CloseBraceRange.End.Byte),
+			key:   block.Labels[0] + "\x00" + block.Labels[1],
+		})
+	}
+
+	sorted := append([]sourceSegment{}, segments...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].key < sorted[j].key
+	})
+
+	var out bytes.Buffer
+	position := 0
+	for i, segment := range segments {
+		out.Write(src[position:segment.start])
+		out.Write(src[sorted[i].start:sorted[i].end])
+		position = segment.end
+	}
+	out.Write(src[position:])
+	return out.Bytes()
+}
+
+// segmentStart returns the start of the line with the offset, moving back over any lines of comments just before it
+func segmentStart(src []byte, offset int) int {
+	start := lineStart(src, offset)
+	for start > 0 {
+		previous := lineStart(src, start-1)
+		line := strings.TrimSpace(string(src[previous:start]))
+		if !strings.HasPrefix(line, "#") && !strings.HasPrefix(line, "//") {
+			break
+		}
+		start = previous
+	}
+	return start
+}
+
+// lineStart returns the offset of the start of the line with the offset
+func lineStart(src []byte, offset int) int {
+	return bytes.LastIndexByte(src[:offset], '\n') + 1
+}
+
+// lineEnd returns the offset just after the end of the line with the offset, including the newline
+func lineEnd(src []byte, offset int) int {
+	next := bytes.IndexByte(src[offset:], '\n')
+	if next < 0 {
+		return len(src)
+	}
+	return offset + next + 1
+}
+
+// sortDependsOn sorts every depends_on list which is just a list of references, lists with comments in them are left
+// alone so the comments are not lost
+func sortDependsOn(body *hclwrite.Body) {
+	for name, attribute := range body.Attributes() {
+		if name != "depends_on" {
+			continue
+		}
+		tokens := attribute.Expr().BuildTokens(nil)
+		if hasComments(tokens) {
+			continue
+		}
+		src := tokens.Bytes()
+		expr, diags := hclsyntax.ParseExpression(src, "", hcl.InitialPos)
+		if diags.HasErrors() {
+			continue
+		}
+		tuple, ok := expr.(*hclsyntax.TupleConsExpr)
+		if !ok {
+			continue
+		}
+		var references []string
+		for _, item := range tuple.Exprs {
+			if _, ok := item.(*hclsyntax.ScopeTraversalExpr); !ok {
+				references = nil
+				break
+			}
+			itemRange := item.Range()
+			references = append(references, string(src[itemRange.Start.Byte:itemRange.End.Byte]))
+		}
+		if references == nil {
+			continue
+		}
+		sort.Strings(references)
+
+		var sorted bytes.Buffer
+		if bytes.ContainsRune(src, '\n') {
+			sorted.WriteString("[\n")
+			for _, reference := range references {
+				sorted.WriteString(reference + ",\n")
+			}
+			sorted.WriteString("]")
+		} else {
+			sorted.WriteString("[" + strings.Join(references, ", ") + "]")
+		}
+		body.SetAttributeRaw(name, hclwrite.Tokens{{Type: hclsyntax.TokenIdent, Bytes: sorted.Bytes()}})
+	}
+
+	for _, block := range body.Blocks() {
+		sortDependsOn(block.Body())
+	}
+}
+
+func hasComments(tokens hclwrite.Tokens) bool {
+	for _, token := range tokens {
+		if token.Type == hclsyntax.TokenComment {
+			return true
+		}
+	}
+	return false
+}
+
+// formatFiles finds the files to format, directories are searched for .hcl files
+func formatFiles(paths []string, recursive bool) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		err = filepath.Walk(path, func(filename string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() && filename != path && !recursive {
+				return filepath.SkipDir
+			}
+			if !info.IsDir() && filepath.Ext(filename) == ".hcl" {
+				files = append(files, filename)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// fmtCommand formats solution, module and pattern files
+func fmtCommand(args []string) {
+	flags := flag.NewFlagSet("design-as-code fmt", flag.ExitOnError)
+	check := flags.Bool("check", false, "Check if the files are formatted, without changing them, and exit with a non-zero status if any are not.")
+	diff := flags.Bool("diff", false, "Print a unified diff of the changes.")
+	write := flags.Bool("write", true, "Write the changes back to the files.")
+	list := flags.Bool("list", true, "List the files which are not formatted.")
+	recursive := flags.Bool("recursive", false, "Also format files in subdirectories.")
+	debugLog := flags.Bool("debug", false, "Should we log verbose messages for debugging?")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: design-as-code fmt [options] [file or directory ...]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *debugLog {
+		log.SetLevel(log.DebugLevel)
+	}
+
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	files, err := formatFiles(paths, *recursive)
+	if err != nil {
+		log.WithError(err).Fatal("Cannot find files to format")
+	}
+
+	sources := make(map[string]*hcl.File)
+	wr := hcl.NewDiagnosticTextWriter(os.Stderr, sources, 78, true)
+	unformatted := false
+	failed := false
+	for _, filename := range files {
+		src, err := ioutil.ReadFile(filename)
+		if err != nil {
+			log.WithError(err).Fatal("Cannot read file")
+		}
+		sources[filename] = &hcl.File{Bytes: src}
+
+		formatted, diags := FormatSource(src, filename)
+		if diags.HasErrors() {
+			wr.WriteDiagnostics(diags)
+			failed = true
+			continue
+		}
+		if bytes.Equal(src, formatted) {
+			log.WithFields(log.Fields{
+				"file": filename,
+			}).Debug("File is formatted")
+			continue
+		}
+
+		unformatted = true
+		if *list {
+			fmt.Println(filename)
+		}
+		if *diff {
+			fmt.Print(UnifiedDiff(filename, filename, src, formatted))
+		}
+		if *write && !*check {
+			if err := ioutil.WriteFile(filename, formatted, 0644); err != nil {
+				log.WithError(err).Fatal("Cannot write file")
+			}
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+	if *check && unformatted {
+		os.Exit(3)
+	}
+}
@@ -2,17 +2,20 @@ module rjk/design-as-code
 
 go 1.17
 
+require (
+	github.com/hashicorp/hcl/v2 v2.10.1
+	github.com/jedib0t/go-pretty/v6 v6.2.4
+	github.com/sirupsen/logrus v1.8.1
+	github.com/zclconf/go-cty v1.8.0
+	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
+)
+
 require (
 	github.com/agext/levenshtein v1.2.1 // indirect
 	github.com/apparentlymart/go-textseg/v13 v13.0.0 // indirect
 	github.com/google/go-cmp v0.3.1 // indirect
-	github.com/hashicorp/hcl/v2 v2.10.1 // indirect
-	github.com/jedib0t/go-pretty/v6 v6.2.4 // indirect
 	github.com/mattn/go-runewidth v0.0.9 // indirect
 	github.com/mitchellh/go-wordwrap v0.0.0-20150314170334-ad45545899c7 // indirect
-	github.com/sirupsen/logrus v1.8.1 // indirect
-	github.com/zclconf/go-cty v1.8.0 // indirect
 	golang.org/x/sys v0.0.0-20191026070338-33540a1f6037 // indirect
 	golang.org/x/text v0.3.5 // indirect
-	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b // indirect
 )
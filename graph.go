@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// graphFormats are the formats the graph command can draw a solution in
+var graphFormats = map[string]bool{
+	"dot":     true,
+	"mermaid": true,
+}
+
+// graphGroupings are the ways the resources can be grouped by the pattern the solver chose for them
+var graphGroupings = map[string]bool{
+	"none":    true,
+	"color":   true,
+	"cluster": true,
+}
+
+// graphColors are the fill colours of the patterns, in the order the solver chose them
+var graphColors = []string{"#a6cee3", "#b2df8a", "#fdbf6f", "#cab2d6", "#fb9a99", "#ffff99", "#8dd3c7", "#bebada", "#fccde5", "#d9d9d9"}
+
+// unmatchedColor is the fill colour of resources no chosen pattern covers
+const unmatchedColor = "#ffffff"
+
+// GraphOptions are how a solution is drawn, attributes are the names of the attributes shown on each resource
+type GraphOptions struct {
+	Attributes []string
+	GroupBy    string
+}
+
+// graphEdge is an edge between two resources, a link is an edge which is not also a dependency
+type graphEdge struct {
+	from string
+	to   string
+	link bool
+}
+
+// graphEdges returns the depends_on edges of the resources, and the links to resources which are not dependencies
+func graphEdges(result MatchResult) []graphEdge {
+	var edges []graphEdge
+	for _, resource := range result.Resources {
+		for _, dependency := range resource.DependsOn {
+			edges = append(edges, graphEdge{from: resource.Address, to: dependency})
+		}
+		for _, link := range resource.Links {
+			if !containsString(resource.DependsOn, link.Target) {
+				edges = append(edges, graphEdge{from: resource.Address, to: link.Target, link: true})
+			}
+		}
+	}
+	return edges
+}
+
+// graphLabel returns the lines of the label of a resource, its address followed by the attributes it has
+func graphLabel(resource ResultResource, attributes []string) []string {
+	lines := []string{resource.Address}
+	for _, name := range attributes {
+		for _, attribute := range resource.Attributes {
+			if attribute.Name == name && attribute.Type != "block" {
+				lines = append(lines, name+" = "+formatValue(attribute.Value))
+			}
+		}
+	}
+	return lines
+}
+
+// patternColors returns the colour of each chosen pattern
+func patternColors(result MatchResult) map[string]string {
+	colors := make(map[string]string)
+	for i, pattern := range result.Patterns {
+		colors[pattern.Name] = graphColors[i%len(graphColors)]
+	}
+	return colors
+}
+
+// graphClusters returns the addresses of the resources covered by each chosen pattern, in the order they were chosen,
+// and the resources which are not covered
+func graphClusters(result MatchResult) ([]ResultPattern, []string) {
+	var unmatched []string
+	for _, resource := range result.Resources {
+		if resource.Pattern == nil {
+			unmatched = append(unmatched, resource.Address)
+		}
+	}
+	return result.Patterns, unmatched
+}
+
+// dotString quotes a string for DOT
+func dotString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+// DotGraph draws a solution in the Graphviz DOT language
+func DotGraph(result MatchResult, options GraphOptions) string {
+	colors := patternColors(result)
+	byAddress := make(map[string]ResultResource)
+	for _, resource := range result.Resources {
+		byAddress[resource.Address] = resource
+	}
+
+	node := func(b *strings.Builder, indent string, resource ResultResource) {
+		attributes := []string{"label=" + dotString(strings.Join(graphLabel(resource, options.Attributes), "\n"))}
+		if options.GroupBy == "color" {
+			color := unmatchedColor
+			if resource.Pattern != nil {
+				color = colors[*resource.Pattern]
+			}
+			attributes = append(attributes, "fillcolor="+dotString(color))
+		}
+		fmt.Fprintf(b, "%s%s [%s];\n", indent, dotString(resource.Address), strings.Join(attributes, ", "))
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "digraph %s {\n", dotString(result.Solution.Name))
+	b.WriteString("  rankdir=LR;\n")
+	b.WriteString("  node [shape=box, style=\"rounded,filled\", fillcolor=\"#ffffff\", fontname=\"Helvetica\"];\n")
+	if options.GroupBy == "cluster" {
+		patterns, unmatched := graphClusters(result)
+		for i, pattern := range patterns {
+			fmt.Fprintf(&b, "  subgraph cluster_%d {\n", i)
+			fmt.Fprintf(&b, "    label=%s;\n", dotString(pattern.Name+"\n"+pattern.Target))
+			b.WriteString("    style=\"rounded,filled\";\n")
+			fmt.Fprintf(&b, "    fillcolor=%s;\n", dotString(colors[pattern.Name]))
+			for _, address := range pattern.Resources {
+				node(&b, "    ", byAddress[address])
+			}
+			b.WriteString("  }\n")
+		}
+		for _, address := range unmatched {
+			node(&b, "  ", byAddress[address])
+		}
+	} else {
+		for _, resource := range result.Resources {
+			node(&b, "  ", resource)
+		}
+	}
+	for _, edge := range graphEdges(result) {
+		style := ""
+		if edge.link {
+			style = " [style=dashed]"
+		}
+		fmt.Fprintf(&b, "  %s -> %s%s;\n", dotString(edge.from), dotString(edge.to), style)
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// mermaidIDs numbers the resources, and anything an edge goes to which is not a resource, for their Mermaid node ids.
+// Addresses can have characters which ids cannot, so the addresses themselves are only used in the labels.
+func mermaidIDs(result MatchResult, edges []graphEdge) (map[string]string, []string) {
+	ids := make(map[string]string)
+	for _, resource := range result.Resources {
+		ids[resource.Address] = fmt.Sprintf("n%d", len(ids))
+	}
+	var missing []string
+	for _, edge := range edges {
+		for _, address := range []string{edge.from, edge.to} {
+			if _, present := ids[address]; !present {
+				ids[address] = fmt.Sprintf("n%d", len(ids))
+				missing = append(missing, address)
+			}
+		}
+	}
+	return ids, missing
+}
+
+// mermaidString escapes a label for Mermaid, lines are separated with <br/>
+func mermaidString(lines []string) string {
+	escaped := make([]string, len(lines))
+	for i, line := range lines {
+		escaped[i] = strings.NewReplacer(`"`, "#quot;", "<", "#lt;", ">", "#gt;").Replace(line)
+	}
+	return `"` + strings.Join(escaped, "<br/>") + `"`
+}
+
+// MermaidGraph draws a solution as a Mermaid flowchart
+func MermaidGraph(result MatchResult, options GraphOptions) string {
+	colors := patternColors(result)
+	byAddress := make(map[string]ResultResource)
+	for _, resource := range result.Resources {
+		byAddress[resource.Address] = resource
+	}
+	edges := graphEdges(result)
+	ids, missing := mermaidIDs(result, edges)
+	node := func(b *strings.Builder, indent string, resource ResultResource) {
+		fmt.Fprintf(b, "%s%s[%s]\n", indent, ids[resource.Address], mermaidString(graphLabel(resource, options.Attributes)))
+	}
+
+	var b strings.Builder
+	b.WriteString("flowchart LR\n")
+	if options.GroupBy == "cluster" {
+		patterns, unmatched := graphClusters(result)
+		for i, pattern := range patterns {
+			fmt.Fprintf(&b, "  subgraph pattern_%d[%s]\n", i, mermaidString([]string{pattern.Name}))
+			for _, address := range pattern.Resources {
+				node(&b, "    ", byAddress[address])
+			}
+			b.WriteString("  end\n")
+		}
+		for _, address := range unmatched {
+			node(&b, "  ", byAddress[address])
+		}
+	} else {
+		for _, resource := range result.Resources {
+			node(&b, "  ", resource)
+		}
+	}
+	for _, address := range missing {
+		fmt.Fprintf(&b, "  %s[%s]\n", ids[address], mermaidString([]string{address}))
+	}
+	for _, edge := range edges {
+		arrow := "-->"
+		if edge.link {
+			arrow = "-.->"
+		}
+		fmt.Fprintf(&b, "  %s %s %s\n", ids[edge.from], arrow, ids[edge.to])
+	}
+
+	switch options.GroupBy {
+	case "color":
+		for i, pattern := range result.Patterns {
+			var classIDs []string
+			for _, address := range pattern.Resources {
+				classIDs = append(classIDs, ids[address])
+			}
+			fmt.Fprintf(&b, "  classDef pattern_%d fill:%s\n", i, colors[pattern.Name])
+			fmt.Fprintf(&b, "  class %s pattern_%d\n", strings.Join(classIDs, ","), i)
+		}
+	case "cluster":
+		for i, pattern := range result.Patterns {
+			fmt.Fprintf(&b, "  style pattern_%d fill:%s\n", i, colors[pattern.Name])
+		}
+	}
+	return b.String()
+}
+
+// keyAttributes returns the attributes shown on resources by default, those which the spec requires and enums
+func keyAttributes(specs map[string]map[string]AttributeSpec) []string {
+	var names []string
+	for resourceType, attributes := range specs {
+		if reservedTypes[resourceType] {
+			continue
+		}
+		for name, spec := range attributes {
+			if (spec.Required || spec.Type == "enum") && !containsString(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// graphCommand draws the resources of a solution and their dependencies, optionally matching it against the pattern
+// library to show the pattern the solver chose for each resource
+func graphCommand(args []string) {
+	flags := flag.NewFlagSet("design-as-code graph", flag.ExitOnError)
+	var solutionOptions solutionOptions
+	solutionOptions.addFlags(flags)
+	options := reportOptions{toolMode: "describe", outputFormat: "table"}
+	flags.StringVar(&options.patternsLibraryFile, "patternlib", "patterns.hcl", "Path to the file containing the list of patterns to use for matching.")
+	flags.StringVar(&options.solveMode, "solvefor", "priority", "What solution mode should we use.")
+	flags.BoolVar(&options.quiet, "quiet", false, "Only log errors.")
+	flags.BoolVar(&options.debugLog, "debug", false, "Should we log verbose messages for debugging?")
+	format := flags.String("format", "dot", "The format of the graph, 'dot' or 'mermaid'.")
+	groupBy := flags.String("by-pattern", "none", "Show the pattern chosen for each resource, 'none', 'color' or 'cluster'.")
+	attributeList := flags.String("attributes", "", "The attributes to show on each resource, separated by commas. (default the required and enum attributes in the spec)")
+	outFile := flags.String("o", "", "Write the graph to this file. (default stdout)")
+	flags.Parse(args)
+
+	if *groupBy != "none" {
+		options.toolMode = "match"
+	}
+	options.setLogLevel()
+	if !graphFormats[*format] {
+		log.WithFields(log.Fields{
+			"format": *format,
+		}).Fatal("Format is incorrect, expecting 'dot' or 'mermaid'")
+	}
+	if !graphGroupings[*groupBy] {
+		log.WithFields(log.Fields{
+			"by-pattern": *groupBy,
+		}).Fatal("Pattern grouping is incorrect, expecting 'none', 'color' or 'cluster'")
+	}
+
+	schemas, typemap, specs, hash := loadSchema()
+	options.specHash = hash
+	var patterns Patterns
+	if options.toolMode == "match" {
+		patterns = loadPatterns(options.patternsLibraryFile)
+	}
+	resources, app := loadSolution(solutionOptions, schemas, typemap, specs)
+	report := reportSolution(resources, app, patterns, typemap, options)
+
+	graphOptions := GraphOptions{GroupBy: *groupBy, Attributes: keyAttributes(specs)}
+	if *attributeList != "" {
+		graphOptions.Attributes = nil
+		for _, name := range strings.Split(*attributeList, ",") {
+			graphOptions.Attributes = append(graphOptions.Attributes, strings.TrimSpace(name))
+		}
+	}
+
+	var buf bytes.Buffer
+	if *format == "dot" {
+		buf.WriteString(DotGraph(report.result, graphOptions))
+	} else {
+		buf.WriteString(MermaidGraph(report.result, graphOptions))
+	}
+	if *outFile == "" {
+		os.Stdout.Write(buf.Bytes())
+		return
+	}
+	if err := ioutil.WriteFile(*outFile, buf.Bytes(), 0644); err != nil {
+		log.WithError(err).Fatal("Error writing the graph")
+	}
+	log.WithFields(log.Fields{
+		"file": *outFile,
+	}).Info("Graph written")
+}
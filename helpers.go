@@ -4,6 +4,7 @@ import (
 	"sort"
 	"strings"
 
+	"github.com/hashicorp/hcl/v2"
 	"github.com/zclconf/go-cty/cty"
 	"github.com/zclconf/go-cty/cty/gocty"
 
@@ -77,6 +78,20 @@ func boolToString(val cty.Value) string {
 	return "false"
 }
 
+// sortDiagnostics puts diagnostics in the order they appear in the source files, as they are often collected by
+// ranging over maps
+func sortDiagnostics(diags hcl.Diagnostics) {
+	sort.SliceStable(diags, func(i, j int) bool {
+		if diags[i].Subject == nil || diags[j].Subject == nil {
+			return diags[j].Subject == nil && diags[i].Subject != nil
+		}
+		if diags[i].Subject.Filename != diags[j].Subject.Filename {
+			return diags[i].Subject.Filename < diags[j].Subject.Filename
+		}
+		return diags[i].Subject.Start.Byte < diags[j].Subject.Start.Byte
+	})
+}
+
 /*
 // trimAll takes the elements of a slice of strings and trims all the whitespace off the strings in the slice
 func trimAll(input []string) []string {
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/zclconf/go-cty/cty"
+	"gopkg.in/yaml.v3"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// importer builds a solution from records read from another system, such as a CMDB export.  Every value is checked
+// against the spec in the same way as the decoder checks a solution file, and anything which does not fit is reported
+// as a warning and left out, so the rest of the records can still be imported.
+type importer struct {
+	typemap   map[string]map[string]string
+	specs     map[string]map[string]AttributeSpec
+	resources map[string]*importedResource
+	order     []string
+	addresses map[string]bool
+	diags     hcl.Diagnostics
+}
+
+// importedResource is a resource being built by the importer, the subject is where it came from in the source file
+type importedResource struct {
+	resource Resource
+	subject  hcl.Range
+}
+
+func newImporter(typemap map[string]map[string]string, specs map[string]map[string]AttributeSpec) *importer {
+	return &importer{
+		typemap:   typemap,
+		specs:     specs,
+		resources: make(map[string]*importedResource),
+		addresses: make(map[string]bool),
+	}
+}
+
+// warn records a problem with a record which has been skipped, the subject is left out if the source does not have
+// positions
+func (im *importer) warn(summary string, detail string, subject hcl.Range) {
+	diag := &hcl.Diagnostic{
+		Severity: hcl.DiagWarning,
+		Summary:  summary,
+		Detail:   detail,
+	}
+	if subject.Filename != "" {
+		diag.Subject = subject.Ptr()
+	}
+	im.diags = append(im.diags, diag)
+}
+
+// AddResource adds a resource of the given type, the id is whatever the source uses to identify the record and the
+// name is turned into a valid resource name
+func (im *importer) AddResource(id string, resourceType string, name string, subject hcl.Range) bool {
+	if _, present := im.typemap[resourceType]; !present || reservedTypes[resourceType] || nestedTypes(im.typemap)[resourceType] {
+		im.warn("Unknown resource type", fmt.Sprintf("%s is mapped to the resource type %s, which is not defined in the spec.", id, resourceType), subject)
+		return false
+	}
+	if _, present := im.resources[id]; present {
+		im.warn("Duplicate record", fmt.Sprintf("%s has already been imported, this record is ignored.", id), subject)
+		return false
+	}
+
+	// names must be unique within a type
+	base := resourceIdentifier(name)
+	resourceName := base
+	for i := 2; im.addresses[makeAddress("", resourceType, resourceName)]; i++ {
+		resourceName = fmt.Sprintf("%s_%d", base, i)
+	}
+	im.addresses[makeAddress("", resourceType, resourceName)] = true
+
+	log.WithFields(log.Fields{
+		"id":           id,
+		"resourceType": resourceType,
+		"resourceName": resourceName,
+	}).Debug("Imported resource")
+
+	im.resources[id] = &importedResource{
+		resource: Resource{
+			resourceType:       resourceType,
+			resourceName:       resourceName,
+			resourceAttributes: make(map[string]interface{}),
+			resourceRange:      subject,
+		},
+		subject: subject,
+	}
+	im.order = append(im.order, id)
+	return true
+}
+
+// SetAttribute sets an attribute of a resource from a value in the source, which is either a string or a value decoded
+// from JSON.  The path can refer to an attribute of a nested block, e.g. sla.rto, or to a key of a map, e.g.
+// tags.owner.  Empty values are ignored.
+func (im *importer) SetAttribute(id string, path string, raw interface{}, subject hcl.Range) {
+	imported, present := im.resources[id]
+	if s, ok := raw.(string); !present || raw == nil || ok && strings.TrimSpace(s) == "" {
+		return
+	}
+
+	blockType := imported.resource.resourceType
+	attributes := imported.resource.resourceAttributes
+	parts := strings.Split(path, ".")
+	for i, part := range parts {
+		spec, present := im.specs[blockType][part]
+		if !present || spec.Type == "depends_on" {
+			im.warn("Unknown attribute", fmt.Sprintf("%s does not have an attribute %s, the value \"%v\" for %s is ignored.", blockType, strings.Join(parts[:i+1], "."), raw, id), subject)
+			return
+		}
+
+		last := i == len(parts)-1
+		if spec.Type == "block" && !last {
+			nested, ok := attributes[part].(map[string]interface{})
+			if !ok {
+				nested = make(map[string]interface{})
+				attributes[part] = nested
+			}
+			blockType = part
+			attributes = nested
+			continue
+		}
+		if spec.Type == "map(string)" && i == len(parts)-2 {
+			m, ok := attributes[part].(map[string]string)
+			if !ok {
+				m = make(map[string]string)
+				attributes[part] = m
+			}
+			m[parts[i+1]] = strings.TrimSpace(importedScalar(raw))
+			return
+		}
+		if !last || spec.Type == "block" {
+			im.warn("Invalid attribute path", fmt.Sprintf("%s.%s is a %s, so it cannot be set from %s, the value \"%v\" for %s is ignored.", blockType, part, spec.Type, path, raw, id), subject)
+			return
+		}
+
+		value, err := ConvertImportedValue(raw, spec)
+		if err != nil {
+			im.warn("Invalid value", fmt.Sprintf("The value \"%v\" for %s of %s is ignored: %v.", raw, path, id, err), subject)
+			return
+		}
+		attribute := &hcl.Attribute{
+			Name:  path,
+			Expr:  hcl.StaticExpr(cty.DynamicVal, subject),
+			Range: subject,
+		}
+		if problems := ValidateValue(attribute, value, spec); problems.HasErrors() {
+			for _, problem := range problems {
+				im.warn(problem.Summary, problem.Detail+" The value for "+id+" is ignored.", subject)
+			}
+			return
+		}
+		attributes[part] = value
+	}
+}
+
+// AddDependency records that one resource depends on another, checking the spec allows it
+func (im *importer) AddDependency(fromID string, toID string, subject hcl.Range) {
+	from, fromPresent := im.resources[fromID]
+	to, toPresent := im.resources[toID]
+	if !fromPresent || !toPresent {
+		missing := fromID
+		if fromPresent {
+			missing = toID
+		}
+		im.warn("Unknown relationship", fmt.Sprintf("The relationship from %s to %s is ignored, %s has not been imported.", fromID, toID, missing), subject)
+		return
+	}
+	if fromID == toID {
+		im.warn("Self-referential dependency", fmt.Sprintf("The relationship from %s to itself is ignored.", fromID), subject)
+		return
+	}
+
+	source := resourceAddress(from.resource)
+	target := resourceAddress(to.resource)
+	if allowed, restricted := im.specs[from.resource.resourceType]["depends_on"]; restricted && !containsString(allowed.Values, to.resource.resourceType) {
+		im.warn("Dependency not allowed", fmt.Sprintf("The relationship from %s to %s is ignored, a %s cannot depend on a %s, the spec allows: %s.", fromID, toID, from.resource.resourceType, to.resource.resourceType, describeAllowed(allowed.Values)), subject)
+		return
+	}
+
+	dependencies := resourceDependencies(from.resource)
+	if containsString(dependencies, target) {
+		return
+	}
+	log.WithFields(log.Fields{
+		"source": source,
+		"target": target,
+	}).Debug("Imported dependency")
+	from.resource.resourceAttributes["depends_on"] = append(dependencies, target)
+}
+
+// Resources finishes the import, filling in defaults from the spec and leaving out any resources which are missing
+// required attributes, and returns the resources in the order they were added
+func (im *importer) Resources() ([]Resource, hcl.Diagnostics) {
+	skipped := make(map[string]bool)
+	for _, id := range im.order {
+		imported := im.resources[id]
+		missing := completeBlock(imported.resource.resourceAttributes, imported.resource.resourceType, im.specs)
+		if len(missing) > 0 {
+			im.warn("Missing required attributes", fmt.Sprintf("%s is not imported, it does not have a value for: %s.", id, strings.Join(missing, ", ")), imported.subject)
+			skipped[resourceAddress(imported.resource)] = true
+		}
+	}
+
+	var resources []Resource
+	ranges := make(map[string]hcl.Range)
+	for _, id := range im.order {
+		imported := im.resources[id]
+		address := resourceAddress(imported.resource)
+		if skipped[address] {
+			continue
+		}
+		var dependencies []string
+		for _, dependency := range resourceDependencies(imported.resource) {
+			if skipped[dependency] {
+				im.warn("Unknown relationship", fmt.Sprintf("The dependency of %s on %s is ignored, %s has not been imported.", address, dependency, dependency), imported.subject)
+				continue
+			}
+			dependencies = append(dependencies, dependency)
+		}
+		if dependencies != nil {
+			imported.resource.resourceAttributes["depends_on"] = dependencies
+		} else {
+			delete(imported.resource.resourceAttributes, "depends_on")
+		}
+		ranges[address] = imported.subject
+		resources = append(resources, imported.resource)
+	}
+
+	// cycles cannot be fixed by leaving out a record, so they are errors
+	diags := append(im.diags, ValidateDependencies(resources, ranges, im.specs, nil)...)
+	sortDiagnostics(diags)
+	return resources, diags
+}
+
+// completeBlock fills in the defaults for a block which has been imported, in the same way as DecodeBlock, and returns
+// the required attributes and blocks which are missing
+func completeBlock(attributes map[string]interface{}, blockType string, specs map[string]map[string]AttributeSpec) []string {
+	var missing []string
+	for name, spec := range specs[blockType] {
+		value, present := attributes[name]
+		if present && spec.Type == "block" {
+			for _, nested := range completeBlock(value.(map[string]interface{}), name, specs) {
+				missing = append(missing, name+"."+nested)
+			}
+			continue
+		}
+		if present {
+			continue
+		}
+		if spec.Required {
+			missing = append(missing, name)
+		}
+		if spec.Default != nil {
+			attributes[name] = spec.Default
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// ConvertImportedValue converts a value from an import, which is either a string or a value decoded from JSON, into the
+// same go type the decoder produces for an attribute
+func ConvertImportedValue(in interface{}, spec AttributeSpec) (interface{}, error) {
+	switch v := in.(type) {
+	case string:
+		return ParseImportedValue(v, spec)
+	case []interface{}:
+		if spec.Type != "list(string)" && spec.Type != "list(int)" {
+			return nil, fmt.Errorf("expecting a %s, not a list", spec.Type)
+		}
+		var items []string
+		for _, item := range v {
+			items = append(items, importedScalar(item))
+		}
+		return ParseImportedValue(strings.Join(items, ","), spec)
+	case map[string]interface{}:
+		if spec.Type != "map(string)" {
+			return nil, fmt.Errorf("expecting a %s, not a map", spec.Type)
+		}
+		out := make(map[string]string)
+		for key, item := range v {
+			out[key] = importedScalar(item)
+		}
+		return out, nil
+	}
+	return ParseImportedValue(importedScalar(in), spec)
+}
+
+// importedScalar formats a single value from an import as a string, whole numbers are written without a decimal point
+func importedScalar(in interface{}) string {
+	if f, ok := in.(float64); ok && f == float64(int64(f)) {
+		return strconv.FormatInt(int64(f), 10)
+	}
+	return fmt.Sprint(in)
+}
+
+// ImportAttributeMapping is the path of the attribute in the source an attribute comes from, e.g. tags.Owner, and
+// optionally a translation of its values, e.g. from sqlserver-se to MSSQL.  It can be given as just the path.
+type ImportAttributeMapping struct {
+	From   string            `yaml:"from"`
+	Values map[string]string `yaml:"values"`
+}
+
+func (m *ImportAttributeMapping) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		m.From = value.Value
+		return nil
+	}
+	type plain ImportAttributeMapping
+	return value.Decode((*plain)(m))
+}
+
+// lookup finds the value of the attribute in a document, translating it if the mapping has a translation for it
+func (m ImportAttributeMapping) lookup(document interface{}) (interface{}, bool) {
+	value, present := lookupImportedPath(document, m.From)
+	if !present {
+		return nil, false
+	}
+	if translated, present := m.Values[importedScalar(value)]; present {
+		return translated, true
+	}
+	return value, true
+}
+
+// lookupImportedPath finds a value in a document decoded from JSON or YAML, the path is a list of keys and list
+// indexes separated by dots, e.g. spec.replicas or root_block_device.0.volume_size.  Keys which contain dots, such as
+// metadata.labels.app.kubernetes.io/name, are found by trying the longest key first.
+func lookupImportedPath(document interface{}, path string) (interface{}, bool) {
+	value := document
+	parts := strings.Split(path, ".")
+	for i := 0; i < len(parts); i++ {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			found := false
+			for j := len(parts); j > i; j-- {
+				if next, present := v[strings.Join(parts[i:j], ".")]; present {
+					value = next
+					i = j - 1
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, false
+			}
+		case []interface{}:
+			index, err := strconv.Atoi(parts[i])
+			if err != nil || index < 0 || index >= len(v) {
+				return nil, false
+			}
+			value = v[index]
+		default:
+			return nil, false
+		}
+	}
+	return value, value != nil
+}
+
+// ParseImportedValue converts a string read from an import into the same go type the decoder produces for an attribute.
+// Lists are separated by commas or semicolons, and maps are given as key=value pairs separated in the same way.
+func ParseImportedValue(raw string, spec AttributeSpec) (interface{}, error) {
+	raw = strings.TrimSpace(raw)
+	switch spec.Type {
+	case "string", "enum":
+		return raw, nil
+	case "bool":
+		switch strings.ToLower(raw) {
+		case "true", "yes", "y", "1":
+			return true, nil
+		case "false", "no", "n", "0":
+			return false, nil
+		}
+		return nil, fmt.Errorf("expecting true or false")
+	case "int":
+		value, err := strconv.Atoi(raw)
+		if err != nil {
+			return nil, fmt.Errorf("expecting a whole number")
+		}
+		return value, nil
+	case "float":
+		value, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return nil, fmt.Errorf("expecting a number")
+		}
+		return value, nil
+	case "list(string)":
+		return splitImportedList(raw), nil
+	case "list(int)":
+		out := []int{}
+		for _, item := range splitImportedList(raw) {
+			value, err := strconv.Atoi(item)
+			if err != nil {
+				return nil, fmt.Errorf("expecting a list of whole numbers")
+			}
+			out = append(out, value)
+		}
+		return out, nil
+	case "map(string)":
+		out := make(map[string]string)
+		for _, item := range splitImportedList(raw) {
+			parts := strings.SplitN(item, "=", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("expecting key=value pairs")
+			}
+			out[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("values of type %s cannot be imported", spec.Type)
+}
+
+// splitImportedList splits a list on commas or semicolons, leaving out empty items
+func splitImportedList(raw string) []string {
+	out := []string{}
+	for _, item := range strings.FieldsFunc(raw, func(r rune) bool { return r == ',' || r == ';' }) {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// resourceIdentifier turns a name from another system into a valid resource name, e.g. "WEB SRV 01" becomes web_srv_01
+func resourceIdentifier(name string) string {
+	var b strings.Builder
+	underscore := false
+	for _, r := range strings.ToLower(strings.TrimSpace(name)) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' {
+			b.WriteRune(r)
+			underscore = false
+			continue
+		}
+		if !underscore {
+			b.WriteRune('_')
+			underscore = true
+		}
+	}
+	identifier := strings.Trim(b.String(), "_")
+	if identifier == "" {
+		return "unnamed"
+	}
+	if identifier[0] >= '0' && identifier[0] <= '9' || identifier[0] == '-' {
+		identifier = "_" + identifier
+	}
+	return identifier
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/gocty"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// resourceInstance is one of the resources which is created from a resource block, there is just one unless the block
+// uses count or for_each
+type resourceInstance struct {
+	name      string
+	variables map[string]cty.Value
+}
+
+var instanceSchema = &hcl.BodySchema{
+	Attributes: []hcl.AttributeSchema{
+		{
+			Name:     "count",
+			Required: false,
+		},
+		{
+			Name:     "for_each",
+			Required: false,
+		},
+	},
+}
+
+// singleInstance is used for resource blocks which are not expanded
+func singleInstance(block *hcl.Block, modulePath string) ([]resourceInstance, cty.Value, hcl.Body) {
+	resourceType := block.Labels[0]
+	resourceName := block.Labels[1]
+	return []resourceInstance{{name: resourceName}}, cty.StringVal(makeAddress(modulePath, resourceType, resourceName)), block.Body
+}
+
+// expandInstances works out the instances for a resource block which uses the count or for_each meta-arguments, like
+// Terraform each instance gets an index in its name, e.g. server.ui[0] or server.ui["blue"], and the expressions in
+// the block can use count.index or each.key and each.value.  It returns the instances, the value which references to
+// the block should resolve to, and the body with the meta-arguments removed.
+func expandInstances(block *hcl.Block, modulePath string, ctx *hcl.EvalContext) ([]resourceInstance, cty.Value, hcl.Body, hcl.Diagnostics) {
+	resourceType := block.Labels[0]
+	resourceName := block.Labels[1]
+
+	content, remain, diags := block.Body.PartialContent(instanceSchema)
+	if diags.HasErrors() {
+		return nil, cty.NilVal, remain, diags
+	}
+
+	countAttr, hasCount := content.Attributes["count"]
+	forEachAttr, hasForEach := content.Attributes["for_each"]
+
+	if hasCount && hasForEach {
+		return nil, cty.NilVal, remain, hcl.Diagnostics{
+			{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid combination of count and for_each",
+				Detail:   "The count and for_each meta-arguments cannot both be used in the same resource.",
+				Subject:  forEachAttr.NameRange.Ptr(),
+			},
+		}
+	}
+
+	var instances []resourceInstance
+
+	if hasCount {
+		val, diags := countAttr.Expr.Value(ctx)
+		if diags.HasErrors() {
+			return nil, cty.NilVal, remain, diags
+		}
+		var count int
+		if err := gocty.FromCtyValue(val, &count); err != nil || count < 0 {
+			return nil, cty.NilVal, remain, hcl.Diagnostics{
+				{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid count argument",
+					Detail:   "The count meta-argument must be a whole number which is zero or more.",
+					Subject:  countAttr.Expr.Range().Ptr(),
+				},
+			}
+		}
+
+		var references []cty.Value
+		for i := 0; i < count; i++ {
+			name := fmt.Sprintf("%s[%d]", resourceName, i)
+			instances = append(instances, resourceInstance{
+				name: name,
+				variables: map[string]cty.Value{
+					"count": cty.ObjectVal(map[string]cty.Value{
+						"index": cty.NumberIntVal(int64(i)),
+					}),
+				},
+			})
+			references = append(references, cty.StringVal(makeAddress(modulePath, resourceType, name)))
+		}
+		log.WithFields(log.Fields{
+			"resource": makeAddress(modulePath, resourceType, resourceName),
+			"count":    count,
+		}).Debug("Expanded resource with count")
+
+		if len(references) == 0 {
+			return instances, cty.EmptyTupleVal, remain, nil
+		}
+		return instances, cty.TupleVal(references), remain, nil
+	}
+
+	if hasForEach {
+		val, diags := forEachAttr.Expr.Value(ctx)
+		if diags.HasErrors() {
+			return nil, cty.NilVal, remain, diags
+		}
+
+		ty := val.Type()
+		isCollection := ty.IsMapType() || ty.IsObjectType() || ty.IsSetType() || ty.IsListType() || ty.IsTupleType()
+		if val.IsNull() || !val.IsKnown() || !isCollection {
+			return nil, cty.NilVal, remain, hcl.Diagnostics{
+				{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid for_each argument",
+					Detail:   "The for_each meta-argument must be a map, or a set or list of strings.",
+					Subject:  forEachAttr.Expr.Range().Ptr(),
+				},
+			}
+		}
+
+		references := make(map[string]cty.Value)
+		for it := val.ElementIterator(); it.Next(); {
+			key, value := it.Element()
+
+			// sets and lists use the value as the key, like toset() in Terraform
+			if !ty.IsMapType() && !ty.IsObjectType() {
+				key = value
+			}
+			if key.Type() != cty.String {
+				return nil, cty.NilVal, remain, hcl.Diagnostics{
+					{
+						Severity: hcl.DiagError,
+						Summary:  "Invalid for_each argument",
+						Detail:   "When for_each is given a set or list, all the elements must be strings.",
+						Subject:  forEachAttr.Expr.Range().Ptr(),
+					},
+				}
+			}
+
+			name := fmt.Sprintf("%s[%q]", resourceName, key.AsString())
+			instances = append(instances, resourceInstance{
+				name: name,
+				variables: map[string]cty.Value{
+					"each": cty.ObjectVal(map[string]cty.Value{
+						"key":   key,
+						"value": value,
+					}),
+				},
+			})
+			references[key.AsString()] = cty.StringVal(makeAddress(modulePath, resourceType, name))
+		}
+		log.WithFields(log.Fields{
+			"resource":  makeAddress(modulePath, resourceType, resourceName),
+			"instances": len(instances),
+		}).Debug("Expanded resource with for_each")
+
+		if len(references) == 0 {
+			return instances, cty.EmptyObjectVal, remain, nil
+		}
+		return instances, cty.ObjectVal(references), remain, nil
+	}
+
+	instances, reference, _ := singleInstance(block, modulePath)
+	return instances, reference, remain, nil
+}
+
+// flattenAddresses turns the value of a depends_on expression into a list of resource addresses, references to
+// resources which have been expanded resolve to a list or map of the instance addresses, so these are flattened
+func flattenAddresses(val cty.Value) ([]string, error) {
+	if val.IsNull() || !val.IsKnown() {
+		return nil, fmt.Errorf("value must be known and not null")
+	}
+	if val.Type() == cty.String {
+		return []string{val.AsString()}, nil
+	}
+	ty := val.Type()
+	if !(ty.IsTupleType() || ty.IsListType() || ty.IsSetType() || ty.IsObjectType() || ty.IsMapType()) {
+		return nil, fmt.Errorf("expecting a list of resources, but got a %s", ty.FriendlyName())
+	}
+	out := []string{}
+	for it := val.ElementIterator(); it.Next(); {
+		_, element := it.Element()
+		addresses, err := flattenAddresses(element)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, addresses...)
+	}
+	return out, nil
+}
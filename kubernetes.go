@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"gopkg.in/yaml.v3"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// K8sMapping maps Kubernetes objects to resource types in the spec, the first rule which matches an object is used
+type K8sMapping struct {
+	Resources []K8sResourceMapping `yaml:"resources"`
+}
+
+// K8sResourceMapping maps objects of a kind, optionally only those with the given labels, to a resource type.
+// Attributes maps attribute paths to paths in the object, and values sets attributes to fixed values.
+type K8sResourceMapping struct {
+	Kind       string                            `yaml:"kind"`
+	Labels     map[string]string                 `yaml:"labels"`
+	Type       string                            `yaml:"type"`
+	Attributes map[string]ImportAttributeMapping `yaml:"attributes"`
+	Values     map[string]string                 `yaml:"values"`
+}
+
+// LoadK8sMapping reads a mapping file for Kubernetes manifests
+func LoadK8sMapping(file string) (K8sMapping, error) {
+	var mapping K8sMapping
+	f, err := os.Open(file)
+	if err != nil {
+		return mapping, err
+	}
+	defer f.Close()
+
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&mapping); err != nil {
+		return mapping, fmt.Errorf("cannot read mapping %s: %v", file, err)
+	}
+
+	if len(mapping.Resources) == 0 {
+		return mapping, fmt.Errorf("mapping %s does not map any kinds", file)
+	}
+	for i, resourceMapping := range mapping.Resources {
+		if resourceMapping.Kind == "" || resourceMapping.Type == "" {
+			return mapping, fmt.Errorf("rule %d in %s needs a kind and a type", i+1, file)
+		}
+		for name, attribute := range resourceMapping.Attributes {
+			if attribute.From == "" {
+				return mapping, fmt.Errorf("attribute '%s' of rule %d in %s does not say which field it comes from", name, i+1, file)
+			}
+		}
+	}
+	return mapping, nil
+}
+
+// find returns the first rule which matches an object
+func (m K8sMapping) find(object k8sObject) (K8sResourceMapping, bool) {
+	for _, resourceMapping := range m.Resources {
+		if resourceMapping.Kind == object.kind && labelsMatch(resourceMapping.Labels, object.labels()) {
+			return resourceMapping, true
+		}
+	}
+	return K8sResourceMapping{}, false
+}
+
+// k8sObject is an object read from a manifest
+type k8sObject struct {
+	kind      string
+	namespace string
+	name      string
+	document  map[string]interface{}
+	subject   hcl.Range
+}
+
+// id identifies the object in diagnostics and dependencies, e.g. Deployment/shop/web
+func (o k8sObject) id() string {
+	return o.kind + "/" + o.namespace + "/" + o.name
+}
+
+// resourceName is the name used for the resource, objects outside the default namespace include the namespace
+func (o k8sObject) resourceName() string {
+	if o.namespace == "default" {
+		return o.name
+	}
+	return o.namespace + "_" + o.name
+}
+
+func (o k8sObject) labels() map[string]string {
+	return stringMap(o.document, "metadata.labels")
+}
+
+// podTemplate returns the path to the pod template of a workload, or false if the object does not run pods
+func (o k8sObject) podTemplate() (string, bool) {
+	switch o.kind {
+	case "Pod":
+		return "", true
+	case "Deployment", "StatefulSet", "DaemonSet", "ReplicaSet", "ReplicationController", "Job":
+		return "spec.template.", true
+	case "CronJob":
+		return "spec.jobTemplate.spec.template.", true
+	}
+	return "", false
+}
+
+// stringMap returns a map of strings at a path in a document, such as a set of labels
+func stringMap(document interface{}, path string) map[string]string {
+	out := make(map[string]string)
+	value, _ := lookupImportedPath(document, path)
+	if m, ok := value.(map[string]interface{}); ok {
+		for key, item := range m {
+			out[key] = importedScalar(item)
+		}
+	}
+	return out
+}
+
+// labelsMatch checks if all the labels in the selector are set to the same value in the labels
+func labelsMatch(selector map[string]string, labels map[string]string) bool {
+	for key, value := range selector {
+		if labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// readManifests reads the objects from every YAML and JSON file in a directory and its subdirectories, files can hold
+// more than one document, and List objects are expanded into their items
+func readManifests(directory string) ([]k8sObject, map[string]*hcl.File, error) {
+	var objects []k8sObject
+	files := make(map[string]*hcl.File)
+
+	err := filepath.Walk(directory, func(filename string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		extension := filepath.Ext(filename)
+		if info.IsDir() || (extension != ".yaml" && extension != ".yml" && extension != ".json") {
+			return nil
+		}
+		src, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		files[filename] = &hcl.File{Bytes: src}
+
+		decoder := yaml.NewDecoder(bytes.NewReader(src))
+		for {
+			var node yaml.Node
+			err := decoder.Decode(&node)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("%s is not valid YAML: %v", filename, err)
+			}
+			if len(node.Content) == 0 {
+				continue
+			}
+			found, err := manifestObjects(node.Content[0], filename, src)
+			if err != nil {
+				return err
+			}
+			objects = append(objects, found...)
+		}
+		return nil
+	})
+	return objects, files, err
+}
+
+// manifestObjects decodes an object from a manifest, or the items of a List
+func manifestObjects(node *yaml.Node, filename string, src []byte) ([]k8sObject, error) {
+	var document map[string]interface{}
+	if err := node.Decode(&document); err != nil {
+		return nil, fmt.Errorf("%s line %d is not a Kubernetes object: %v", filename, node.Line, err)
+	}
+
+	kind := importedScalar(document["kind"])
+	if strings.HasSuffix(kind, "List") {
+		var objects []k8sObject
+		for i := 0; i+1 < len(node.Content); i = i + 2 {
+			if node.Content[i].Value != "items" {
+				continue
+			}
+			for _, item := range node.Content[i+1].Content {
+				found, err := manifestObjects(item, filename, src)
+				if err != nil {
+					return nil, err
+				}
+				objects = append(objects, found...)
+			}
+		}
+		return objects, nil
+	}
+
+	name, _ := lookupImportedPath(document, "metadata.name")
+	if document["kind"] == nil || name == nil {
+		log.WithFields(log.Fields{
+			"file": filename,
+			"line": node.Line,
+		}).Debug("Skipping document without a kind and name")
+		return nil, nil
+	}
+	namespace, present := lookupImportedPath(document, "metadata.namespace")
+	if !present {
+		namespace = "default"
+	}
+	return []k8sObject{{
+		kind:      kind,
+		namespace: importedScalar(namespace),
+		name:      importedScalar(name),
+		document:  document,
+		subject:   lineRange(filename, src, node.Line),
+	}}, nil
+}
+
+// lineRange returns the range of a whole line in a file, for diagnostics
+func lineRange(filename string, src []byte, line int) hcl.Range {
+	start := 0
+	for i := 1; i < line && start < len(src); i++ {
+		next := bytes.IndexByte(src[start:], '\n')
+		if next < 0 {
+			start = len(src)
+			break
+		}
+		start = start + next + 1
+	}
+	end := len(src)
+	if next := bytes.IndexByte(src[start:], '\n'); next >= 0 {
+		end = start + next
+	}
+	return hcl.Range{
+		Filename: filename,
+		Start:    hcl.Pos{Line: line, Column: 1, Byte: start},
+		End:      hcl.Pos{Line: line, Column: end - start + 1, Byte: end},
+	}
+}
+
+// k8sReferences finds the objects each object refers to: Services refer to the workloads their selector matches,
+// Ingresses to their backend Services, and workloads to the PersistentVolumeClaims they mount
+func k8sReferences(objects []k8sObject) (map[string][]string, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+	references := make(map[string][]string)
+	byID := make(map[string]k8sObject)
+	for _, object := range objects {
+		byID[object.id()] = object
+	}
+
+	refer := func(source k8sObject, kind string, name string) {
+		target := kind + "/" + source.namespace + "/" + name
+		if _, present := byID[target]; !present {
+			subject := source.subject
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagWarning,
+				Summary:  "Unknown reference",
+				Detail:   fmt.Sprintf("%s refers to %s, which is not in the manifests.", source.id(), target),
+				Subject:  &subject,
+			})
+			return
+		}
+		if !containsString(references[source.id()], target) {
+			references[source.id()] = append(references[source.id()], target)
+		}
+	}
+
+	for _, object := range objects {
+		switch object.kind {
+		case "Service":
+			selector := stringMap(object.document, "spec.selector")
+			if len(selector) == 0 {
+				continue
+			}
+			for _, workload := range objects {
+				template, runsPods := workload.podTemplate()
+				if runsPods && workload.namespace == object.namespace && labelsMatch(selector, stringMap(workload.document, template+"metadata.labels")) {
+					references[object.id()] = append(references[object.id()], workload.id())
+				}
+			}
+		case "Ingress":
+			var services []string
+			for _, path := range []string{"spec.defaultBackend.service.name", "spec.backend.serviceName"} {
+				if name, present := lookupImportedPath(object.document, path); present {
+					services = append(services, importedScalar(name))
+				}
+			}
+			rules, _ := lookupImportedPath(object.document, "spec.rules")
+			ruleList, _ := rules.([]interface{})
+			for _, rule := range ruleList {
+				paths, _ := lookupImportedPath(rule, "http.paths")
+				pathList, _ := paths.([]interface{})
+				for _, path := range pathList {
+					for _, backend := range []string{"backend.service.name", "backend.serviceName"} {
+						if name, present := lookupImportedPath(path, backend); present {
+							services = append(services, importedScalar(name))
+						}
+					}
+				}
+			}
+			for _, service := range services {
+				refer(object, "Service", service)
+			}
+		default:
+			template, runsPods := object.podTemplate()
+			if !runsPods {
+				continue
+			}
+			volumes, _ := lookupImportedPath(object.document, template+"spec.volumes")
+			volumeList, _ := volumes.([]interface{})
+			for _, volume := range volumeList {
+				if claim, present := lookupImportedPath(volume, "persistentVolumeClaim.claimName"); present {
+					refer(object, "PersistentVolumeClaim", importedScalar(claim))
+				}
+			}
+		}
+	}
+	return references, diags
+}
+
+// ImportK8s builds a solution from Kubernetes objects.  Objects which are not in the mapping are left out, but
+// references are followed through them, so if Services are not mapped then an Ingress depends on the workloads behind
+// its Services.
+func ImportK8s(mapping K8sMapping, objects []k8sObject, typemap map[string]map[string]string, specs map[string]map[string]AttributeSpec) ([]Resource, hcl.Diagnostics) {
+	im := newImporter(typemap, specs)
+	imported := make(map[string]bool)
+	unmapped := make(map[string]int)
+
+	for _, object := range objects {
+		resourceMapping, present := mapping.find(object)
+		if !present {
+			// workloads are what the solution is made of, so it is worth saying when they are left out
+			if _, runsPods := object.podTemplate(); runsPods {
+				unmapped[object.kind]++
+			}
+			log.WithFields(log.Fields{
+				"object": object.id(),
+			}).Debug("Object is not mapped")
+			continue
+		}
+		id := object.id()
+		if !im.AddResource(id, resourceMapping.Type, object.resourceName(), object.subject) {
+			continue
+		}
+		imported[id] = true
+
+		for _, name := range sortedKeys(resourceMapping.Values) {
+			im.SetAttribute(id, name, resourceMapping.Values[name], object.subject)
+		}
+		var names []string
+		for name := range resourceMapping.Attributes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if value, present := resourceMapping.Attributes[name].lookup(object.document); present {
+				im.SetAttribute(id, name, value, object.subject)
+			}
+		}
+	}
+
+	var unmappedKinds []string
+	for kind := range unmapped {
+		unmappedKinds = append(unmappedKinds, kind)
+	}
+	sort.Strings(unmappedKinds)
+	for _, kind := range unmappedKinds {
+		im.warn("Unmapped kind", fmt.Sprintf("%d %s objects are not in the mapping, they are ignored.", unmapped[kind], kind), hcl.Range{})
+	}
+
+	references, diags := k8sReferences(objects)
+	im.diags = append(im.diags, diags...)
+	for _, object := range objects {
+		if !imported[object.id()] {
+			continue
+		}
+		for _, target := range importedReferences(references, imported, object.id()) {
+			im.AddDependency(object.id(), target, object.subject)
+		}
+	}
+
+	return im.Resources()
+}
+
+// importedReferences follows the references from an object until it reaches objects which have been imported
+func importedReferences(references map[string][]string, imported map[string]bool, source string) []string {
+	var out []string
+	visited := map[string]bool{source: true}
+	stack := append([]string{}, references[source]...)
+	for len(stack) > 0 {
+		current := stack[0]
+		stack = stack[1:]
+		if visited[current] {
+			continue
+		}
+		visited[current] = true
+		if imported[current] {
+			out = append(out, current)
+			continue
+		}
+		stack = append(stack, references[current]...)
+	}
+	return out
+}
+
+// importK8sCommand imports a solution from Kubernetes manifests, and either matches it or writes it out as HCL
+func importK8sCommand(args []string) {
+	flags := flag.NewFlagSet("design-as-code import-k8s", flag.ExitOnError)
+	var options reportOptions
+	options.addFlags(flags)
+	mappingFile := flags.String("mapping", "k8s-mapping.yml", "Path to the file which maps Kubernetes objects to resource types and attributes.")
+	manifestDirectory := flags.String("manifests", ".", "Path to the directory with the manifests.")
+	solutionName := flags.String("solution-name", "", "The name of the solution. (default the name of the directory with the manifests)")
+	solutionNumber := flags.String("solution-number", "", "The number of the solution.")
+	outFile := flags.String("out", "", "Write the solution as HCL to this file, instead of matching it.")
+	flags.Parse(args)
+
+	options.setLogLevel()
+
+	_, typemap, specs, _ := loadSchema()
+
+	mapping, err := LoadK8sMapping(*mappingFile)
+	if err != nil {
+		log.WithError(err).Fatal("Cannot continue")
+	}
+
+	objects, files, err := readManifests(*manifestDirectory)
+	if err != nil {
+		log.WithError(err).Fatal("Cannot read manifests")
+	}
+	log.WithFields(log.Fields{
+		"count": len(objects),
+	}).Info("Read manifests")
+
+	app := Solution{solutionName: *solutionName, solutionNumber: *solutionNumber}
+	if app.solutionName == "" {
+		directory, _ := filepath.Abs(*manifestDirectory)
+		app.solutionName = filepath.Base(directory)
+	}
+
+	resources, diags := ImportK8s(mapping, objects, typemap, specs)
+	exitOnImportErrors(diags, files)
+	log.WithFields(log.Fields{
+		"count": len(resources),
+	}).Info("Imported resources")
+
+	if *outFile != "" {
+		writeSolutionFile(*outFile, resources, app, typemap)
+		return
+	}
+
+	patterns := loadPatterns(options.patternsLibraryFile)
+	writeReports(options, []solutionReport{reportSolution(resources, app, patterns, typemap, options)})
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclparse"
+	"gopkg.in/yaml.v3"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// LintConfig turns lint rules on and off and configures them, keyed by rule id.  Rules which are not in the config
+// run with their defaults.
+type LintConfig struct {
+	Rules map[string]LintRuleConfig `yaml:"rules"`
+}
+
+// LintRuleConfig configures a lint rule.  Types are the resource types the rule looks at, and targets are the types
+// of the resources they depend on which it looks at, pattern is the naming convention and tag is the owner tag.
+type LintRuleConfig struct {
+	Enabled  *bool    `yaml:"enabled"`
+	Severity string   `yaml:"severity"`
+	Types    []string `yaml:"types"`
+	Targets  []string `yaml:"targets"`
+	Pattern  string   `yaml:"pattern"`
+	Tag      string   `yaml:"tag"`
+}
+
+// lintFinding is a problem a lint rule found with a resource
+type lintFinding struct {
+	resource Resource
+	detail   string
+}
+
+// lintRule is a check of the design of a solution, the id is the summary of its diagnostics as a rule id
+type lintRule struct {
+	id       string
+	summary  string
+	severity string
+	defaults LintRuleConfig
+	check    func(resources []Resource, config LintRuleConfig) []lintFinding
+}
+
+// lintRules are all the lint rules, in the order they run
+var lintRules = []lintRule{
+	{
+		id:       "orphan-resource",
+		summary:  "Orphan resource",
+		severity: "warning",
+		check:    lintOrphans,
+	},
+	{
+		id:       "database-without-resilience",
+		summary:  "Database without resilience",
+		severity: "warning",
+		defaults: LintRuleConfig{Types: []string{"database"}},
+		check:    lintDatabaseResilience,
+	},
+	{
+		id:       "single-instance-behind-load-balancer",
+		summary:  "Single instance behind load balancer",
+		severity: "warning",
+		defaults: LintRuleConfig{Types: []string{"load_balancer"}, Targets: []string{"server"}},
+		check:    lintSingleInstances,
+	},
+	{
+		id:       "naming-convention",
+		summary:  "Naming convention",
+		severity: "warning",
+		defaults: LintRuleConfig{Pattern: "^[a-z][a-z0-9_]*$"},
+		check:    lintNaming,
+	},
+	{
+		id:       "missing-owner-tag",
+		summary:  "Missing owner tag",
+		severity: "warning",
+		defaults: LintRuleConfig{Tag: "owner"},
+		check:    lintOwnerTag,
+	},
+}
+
+// LoadLintConfig reads a lint config file, and checks the rules and settings in it exist
+func LoadLintConfig(file string) (LintConfig, error) {
+	var config LintConfig
+	f, err := os.Open(file)
+	if err != nil {
+		return config, err
+	}
+	defer f.Close()
+
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&config); err != nil {
+		return config, fmt.Errorf("cannot read lint config %s: %v", file, err)
+	}
+
+	for id, ruleConfig := range config.Rules {
+		if _, found := findLintRule(id); !found {
+			return config, fmt.Errorf("'%s' is not a lint rule", id)
+		}
+		if ruleConfig.Severity != "" && ruleConfig.Severity != "error" && ruleConfig.Severity != "warning" {
+			return config, fmt.Errorf("the severity of '%s' must be 'error' or 'warning'", id)
+		}
+		if ruleConfig.Pattern != "" {
+			if _, err := regexp.Compile(ruleConfig.Pattern); err != nil {
+				return config, fmt.Errorf("the pattern of '%s' is not a valid regular expression: %v", id, err)
+			}
+		}
+	}
+	return config, nil
+}
+
+func findLintRule(id string) (lintRule, bool) {
+	for _, rule := range lintRules {
+		if rule.id == id {
+			return rule, true
+		}
+	}
+	return lintRule{}, false
+}
+
+// settings returns the config for the rule, with the defaults for anything the config does not set
+func (r lintRule) settings(config LintConfig) (LintRuleConfig, bool, hcl.DiagnosticSeverity) {
+	settings := config.Rules[r.id]
+	if settings.Enabled != nil && !*settings.Enabled {
+		return settings, false, hcl.DiagWarning
+	}
+	if settings.Types == nil {
+		settings.Types = r.defaults.Types
+	}
+	if settings.Targets == nil {
+		settings.Targets = r.defaults.Targets
+	}
+	if settings.Pattern == "" {
+		settings.Pattern = r.defaults.Pattern
+	}
+	if settings.Tag == "" {
+		settings.Tag = r.defaults.Tag
+	}
+	if settings.Severity == "" {
+		settings.Severity = r.severity
+	}
+	severity := hcl.DiagWarning
+	if settings.Severity == "error" {
+		severity = hcl.DiagError
+	}
+	return settings, true, severity
+}
+
+// Lint runs the enabled lint rules over the resources of a solution
+func Lint(resources []Resource, config LintConfig) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+	for _, rule := range lintRules {
+		settings, enabled, severity := rule.settings(config)
+		if !enabled {
+			log.WithFields(log.Fields{
+				"rule": rule.id,
+			}).Debug("Lint rule is disabled")
+			continue
+		}
+		for _, finding := range rule.check(resources, settings) {
+			diag := &hcl.Diagnostic{
+				Severity: severity,
+				Summary:  rule.summary,
+				Detail:   finding.detail,
+			}
+			if finding.resource.resourceRange.Filename != "" {
+				diag.Subject = finding.resource.resourceRange.Ptr()
+			}
+			diags = append(diags, diag)
+		}
+	}
+	sortDiagnostics(diags)
+	return diags
+}
+
+// resourceTargets returns the addresses of the resources a resource depends on or links to
+func resourceTargets(resource Resource) []string {
+	targets := append([]string{}, resourceDependencies(resource)...)
+	for _, link := range resource.resourceLinks {
+		if !containsString(targets, link.target) {
+			targets = append(targets, link.target)
+		}
+	}
+	return targets
+}
+
+// baseAddress removes the index from the address of an expanded instance, e.g. server.ui[0] becomes server.ui
+func baseAddress(address string) string {
+	if i := strings.Index(address, "["); i >= 0 {
+		return address[:i]
+	}
+	return address
+}
+
+// lintOrphans finds resources which do not depend on or link to anything, and which nothing depends on or links to
+func lintOrphans(resources []Resource, config LintRuleConfig) []lintFinding {
+	if len(resources) < 2 {
+		return nil
+	}
+	used := make(map[string]bool)
+	for _, resource := range resources {
+		for _, target := range resourceTargets(resource) {
+			used[target] = true
+		}
+	}
+	var findings []lintFinding
+	for _, resource := range resources {
+		if len(resourceTargets(resource)) == 0 && !used[resourceAddress(resource)] {
+			findings = append(findings, lintFinding{
+				resource: resource,
+				detail:   fmt.Sprintf("Nothing depends on %s and it does not depend on anything, is it part of this solution?", resourceAddress(resource)),
+			})
+		}
+	}
+	return findings
+}
+
+// lintDatabaseResilience finds databases which are not highly available and do not have an sla
+func lintDatabaseResilience(resources []Resource, config LintRuleConfig) []lintFinding {
+	var findings []lintFinding
+	for _, resource := range resources {
+		if !containsString(config.Types, resource.resourceType) {
+			continue
+		}
+		var missing []string
+		if ha, _ := resource.resourceAttributes["ha"].(bool); !ha {
+			missing = append(missing, "does not set ha = true")
+		}
+		if _, present := resource.resourceAttributes["sla"]; !present {
+			missing = append(missing, "does not have an sla block")
+		}
+		if len(missing) > 0 {
+			findings = append(findings, lintFinding{
+				resource: resource,
+				detail:   fmt.Sprintf("%s %s.", resourceAddress(resource), strings.Join(missing, " and ")),
+			})
+		}
+	}
+	return findings
+}
+
+// lintSingleInstances finds load balancers which only have a single instance of a resource behind them, the number of
+// instances is the number of expanded instances, or the count attribute if they are not expanded
+func lintSingleInstances(resources []Resource, config LintRuleConfig) []lintFinding {
+	byAddress := make(map[string]Resource)
+	for _, resource := range resources {
+		byAddress[resourceAddress(resource)] = resource
+	}
+
+	var findings []lintFinding
+	for _, resource := range resources {
+		if !containsString(config.Types, resource.resourceType) {
+			continue
+		}
+		instances := make(map[string]int)
+		var order []string
+		for _, target := range resourceTargets(resource) {
+			targetResource, present := byAddress[target]
+			if !present || !containsString(config.Targets, targetResource.resourceType) {
+				continue
+			}
+			base := baseAddress(target)
+			if _, seen := instances[base]; !seen {
+				order = append(order, base)
+			}
+			if base != target {
+				instances[base]++
+			} else if count, ok := targetResource.resourceAttributes["count"].(int); ok {
+				instances[base] = count
+			} else {
+				instances[base] = 1
+			}
+		}
+		for _, base := range order {
+			if instances[base] < 2 {
+				findings = append(findings, lintFinding{
+					resource: resource,
+					detail:   fmt.Sprintf("%s is behind %s, but there is only one instance of it.", base, resourceAddress(resource)),
+				})
+			}
+		}
+	}
+	return findings
+}
+
+// lintNaming finds resources with names which do not follow the naming convention, expanded instances are only
+// reported once
+func lintNaming(resources []Resource, config LintRuleConfig) []lintFinding {
+	convention := regexp.MustCompile(config.Pattern)
+	reported := make(map[string]bool)
+	var findings []lintFinding
+	for _, resource := range resources {
+		name := baseAddress(resource.resourceName)
+		address := baseAddress(resourceAddress(resource))
+		if convention.MatchString(name) || reported[address] {
+			continue
+		}
+		reported[address] = true
+		findings = append(findings, lintFinding{
+			resource: resource,
+			detail:   fmt.Sprintf("The name of %s does not match the naming convention %s.", address, config.Pattern),
+		})
+	}
+	return findings
+}
+
+// lintOwnerTag finds resources without an owner tag
+func lintOwnerTag(resources []Resource, config LintRuleConfig) []lintFinding {
+	var findings []lintFinding
+	for _, resource := range resources {
+		tags, _ := resource.resourceAttributes["tags"].(map[string]string)
+		if strings.TrimSpace(tags[config.Tag]) == "" {
+			findings = append(findings, lintFinding{
+				resource: resource,
+				detail:   fmt.Sprintf("%s does not have the %s tag.", resourceAddress(resource), config.Tag),
+			})
+		}
+	}
+	return findings
+}
+
+// lintRuleIDs returns the ids of the lint rules, for the usage message
+func lintRuleIDs() []string {
+	var ids []string
+	for _, rule := range lintRules {
+		ids = append(ids, rule.id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// lintCommand loads a solution and runs the lint rules over it, any problems loading the solution are reported in the
+// same way as the findings
+func lintCommand(args []string) {
+	flags := flag.NewFlagSet("design-as-code lint", flag.ExitOnError)
+	var solutionOptions solutionOptions
+	solutionOptions.addFlags(flags)
+	specFile := flags.String("spec", defaultSpecFile, "Path to the spec.")
+	configFile := flags.String("config", "", "Path to the lint config, which turns rules on and off and sets their severity.")
+	format := flags.String("format", "text", "How to write the diagnostics, 'text', 'json' or 'sarif'.")
+	debugLog := flags.Bool("debug", false, "Should we log verbose messages for debugging?")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: design-as-code lint [options]\n\nRules: %s\n\n", strings.Join(lintRuleIDs(), ", "))
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *debugLog {
+		log.SetLevel(log.DebugLevel)
+	}
+	if !diagnosticFormats[*format] {
+		log.WithFields(log.Fields{
+			"format": *format,
+		}).Fatal("Format is incorrect, expecting 'text', 'json' or 'sarif'")
+	}
+
+	var config LintConfig
+	if *configFile != "" {
+		var err error
+		config, err = LoadLintConfig(*configFile)
+		if err != nil {
+			log.WithError(err).Fatal("Cannot continue")
+		}
+	}
+
+	p := hclparse.NewParser()
+	schemas, typemap, specs, diags := readSpec(*specFile)
+	if !diags.HasErrors() {
+		resources, _, solutionDiags := decodeSolution(p, solutionOptions, schemas, typemap, specs)
+		diags = append(diags, solutionDiags...)
+		if !diags.HasErrors() {
+			diags = append(diags, Lint(resources, config)...)
+		}
+	}
+	exitWithDiagnostics(diags, *format, p.Files())
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
@@ -13,193 +14,427 @@ import (
 	"github.com/hashicorp/hcl/v2/hclparse"
 )
 
-func main() {
+// stringList is a flag which can be given more than once
+type stringList []string
 
-	// need to get the command line parameters
-	patternsLibraryFile := flag.String("patternlib", "patterns.hcl", "Path to the file containing the list of patterns to use for matching.")
-	solutionDescriptor := flag.String("app", "app.hcl", "Path to the file containing the list of patterns to use for matching.")
-	toolMode := flag.String("mode", "match", "What should the tool do 'match' or 'describe'")
-	solveMode := flag.String("solvefor", "priority", "What solution mode should we use.")
-	jsonFileOut := flag.String("json", "", "Should we output to json, if so, what file name.")
-	debugLog := flag.Bool("debug", false, "Should we log verbose messages for debugging?")
-	traceLog := flag.Bool("trace", false, "Should we log verbose messages for debugging?")
-	flag.Parse()
+func (s *stringList) String() string {
+	return strings.Join(*s, ", ")
+}
 
-	if *debugLog {
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// reportOptions are the flags shared by every command which matches a solution against the pattern library
+type reportOptions struct {
+	patternsLibraryFile string
+	toolMode            string
+	solveMode           string
+	jsonFileOut         string
+	resultFileOut       string
+	outputFormat        string
+	outputFile          string
+	templateFile        string
+	quiet               bool
+	debugLog            bool
+	traceLog            bool
+	specHash            string
+}
+
+func (o *reportOptions) addFlags(flags *flag.FlagSet) {
+	flags.StringVar(&o.patternsLibraryFile, "patternlib", "patterns.hcl", "Path to the file containing the list of patterns to use for matching.")
+	flags.StringVar(&o.toolMode, "mode", "match", "What should the tool do 'match' or 'describe'")
+	flags.StringVar(&o.solveMode, "solvefor", "priority", "What solution mode should we use.")
+	flags.StringVar(&o.jsonFileOut, "json", "", "Should we output to json, if so, what file name.")
+	flags.StringVar(&o.resultFileOut, "result", "", "Write the result document, in versioned JSON, to this file.")
+	flags.StringVar(&o.outputFormat, "output-format", "table", "How to write the results, 'table', 'json', 'ndjson', 'yaml', 'csv', 'markdown' or 'xlsx'.")
+	flags.StringVar(&o.outputFile, "o", "", "Write the results to this file. (default stdout)")
+	flags.StringVar(&o.templateFile, "template", "", "Write the results with this Go template, instead of in the output format.")
+	flags.BoolVar(&o.quiet, "quiet", false, "Only log errors.")
+	flags.BoolVar(&o.debugLog, "debug", false, "Should we log verbose messages for debugging?")
+	flags.BoolVar(&o.traceLog, "trace", false, "Should we log verbose messages for debugging?")
+}
+
+// setLogLevel applies the quiet, debug and trace flags, and checks the tool mode and output format.  The logs go to
+// stderr so they do not get mixed up with the results.
+func (o *reportOptions) setLogLevel() {
+	log.SetOutput(os.Stderr)
+
+	if o.quiet {
+		log.SetLevel(log.ErrorLevel)
+	}
+
+	if o.debugLog {
 		log.SetLevel(log.DebugLevel)
 	}
 
-	if *traceLog {
+	if o.traceLog {
 		log.SetLevel(log.TraceLevel)
 	}
 
-	if *toolMode != "match" && *toolMode != "describe" {
+	if o.toolMode != "match" && o.toolMode != "describe" {
 		log.Fatal("Tool mode (mode) is incorrect, expecting 'match' or 'describe'")
 	}
 
-	log.Info("Running...")
-	log.WithFields(log.Fields{
-		"patternLibraryFile": *patternsLibraryFile,
-	}).Info("Patterns library file")
-	log.WithFields(log.Fields{
-		"solutionDescriptorFile": *solutionDescriptor,
-	}).Info("Solution descriptor file")
+	if !outputFormats[o.outputFormat] {
+		log.WithFields(log.Fields{
+			"format": o.outputFormat,
+		}).Fatal("Output format is incorrect, expecting 'table', 'json', 'ndjson', 'yaml', 'csv', 'markdown' or 'xlsx'")
+	}
+
+	if o.outputFormat == "xlsx" && o.outputFile == "" && o.templateFile == "" {
+		log.Fatal("The xlsx output format needs a file to write the workbook to (o)")
+	}
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "import-csv":
+			importCSVCommand(os.Args[2:])
+			return
+		case "import-tfstate":
+			importTFStateCommand(os.Args[2:])
+			return
+		case "import-k8s":
+			importK8sCommand(os.Args[2:])
+			return
+		case "write":
+			writeCommand(os.Args[2:])
+			return
+		case "fmt":
+			fmtCommand(os.Args[2:])
+			return
+		case "validate":
+			validateCommand(os.Args[2:])
+			return
+		case "lint":
+			lintCommand(os.Args[2:])
+			return
+		case "policy":
+			policyCommand(os.Args[2:])
+			return
+		case "report":
+			reportCommand(os.Args[2:])
+			return
+		case "graph":
+			graphCommand(os.Args[2:])
+			return
+		}
+	}
+	matchCommand(os.Args[1:])
+}
 
+// loadSchema reads solution-spec.yml, the hash of the spec is returned for the result document
+func loadSchema() (map[string]hcl.BodySchema, map[string]map[string]string, map[string]map[string]AttributeSpec, string) {
 	log.Info("Loading solution schema...")
 	schemas := make(map[string]hcl.BodySchema)
 	typemap := make(map[string]map[string]string)
-	schemareaderr := ReadSchema(schemas, typemap)
+	specs := make(map[string]map[string]AttributeSpec)
+	spec, schemareaderr := ReadSchema(defaultSpecFile, schemas, typemap, specs)
 	if schemareaderr != nil {
 		log.WithError(schemareaderr).Fatal("Cannot continue")
 	}
+	return schemas, typemap, specs, specHash(spec)
+}
 
+// loadPatterns reads the pattern library
+func loadPatterns(patternsLibraryFile string) Patterns {
 	log.Info("Loading patterns...")
-	var patterns Patterns
-	patterns, err := LoadPatternLibrary(*patternsLibraryFile)
+	patterns, err := LoadPatternLibrary(patternsLibraryFile)
 	if err != nil {
 		log.Fatal("Failed to load patterns: ", err)
 	}
 	log.WithFields(log.Fields{
 		"count": len(patterns.PatternSet),
 	}).Info("Loaded pattern library")
+	return patterns
+}
+
+// solutionOptions are the flags for loading a solution file
+type solutionOptions struct {
+	solutionDescriptor string
+	expandInstances    bool
+	variableValues     stringList
+	variableFiles      stringList
+}
 
+func (o *solutionOptions) addFlags(flags *flag.FlagSet) {
+	flags.StringVar(&o.solutionDescriptor, "app", "app.hcl", "Path to the solution file, in HCL, JSON (.json) or YAML (.yml, .yaml).")
+	flags.BoolVar(&o.expandInstances, "expand", false, "Should count and for_each expand resources into individual instances?")
+	flags.Var(&o.variableValues, "var", "Set a value for a variable in the solution, e.g. -var 'env=prod', can be repeated.")
+	flags.Var(&o.variableFiles, "var-file", "Path to a file which sets values for variables in the solution, can be repeated.")
+}
+
+// loadSolution parses and decodes the solution file, printing any problems, and exits if there are any errors
+func loadSolution(options solutionOptions, schemas map[string]hcl.BodySchema, typemap map[string]map[string]string, specs map[string]map[string]AttributeSpec) ([]Resource, Solution) {
 	p := hclparse.NewParser()
 
 	wr := hcl.NewDiagnosticTextWriter(
-		os.Stdout, // writer to send messages to
+		os.Stderr, // writer to send messages to
 		p.Files(), // the parser's file cache, for source snippets
 		78,        // wrapping width
 		true,      // generate colored/highlighted output
 	)
 
-	_, diagnostics := p.ParseHCLFile(*solutionDescriptor)
-	if diagnostics != nil && diagnostics.HasErrors() {
+	resources, app, diagnostics := decodeSolution(p, options, schemas, typemap, specs)
+	if diagnostics.HasErrors() {
 		wr.WriteDiagnostics(diagnostics)
+		log.Fatal("Unrecoverable error")
 	}
+	return resources, app
+}
 
-	for _, file := range p.Files() {
-		contents, diagnostics := file.Body.Content(solutionSchema)
-		if diagnostics != nil && diagnostics.HasErrors() {
-			wr.WriteDiagnostics(diagnostics)
+// decodeSolution parses and decodes the solution file and any variable files, the files are kept by the parser so
+// the diagnostics can show the source
+func decodeSolution(p *hclparse.Parser, options solutionOptions, schemas map[string]hcl.BodySchema, typemap map[string]map[string]string, specs map[string]map[string]AttributeSpec) ([]Resource, Solution, hcl.Diagnostics) {
+	decodeOptions := DecodeOptions{
+		ExpandInstances: options.expandInstances,
+		VariableValues:  make(map[string]string),
+		BaseDirectory:   filepath.Dir(options.solutionDescriptor),
+		Parser:          p,
+	}
+	var diags hcl.Diagnostics
+	for _, variableValue := range options.variableValues {
+		parts := strings.SplitN(variableValue, "=", 2)
+		if len(parts) != 2 {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid variable value",
+				Detail:   fmt.Sprintf("The value %q must be given as name=value.", variableValue),
+			})
+			continue
+		}
+		decodeOptions.VariableValues[parts[0]] = parts[1]
+	}
+	for _, variableFile := range options.variableFiles {
+		file, fileDiags := ParseSolutionFile(p, variableFile)
+		diags = append(diags, fileDiags...)
+		if file != nil {
+			decodeOptions.VariableFiles = append(decodeOptions.VariableFiles, file.Body)
 		}
+	}
+
+	file, fileDiags := ParseSolutionFile(p, options.solutionDescriptor)
+	diags = append(diags, fileDiags...)
+	if diags.HasErrors() {
+		return nil, Solution{}, diags
+	}
+
+	contents, contentDiags := file.Body.Content(solutionSchema)
+	diags = append(diags, contentDiags...)
+	if diags.HasErrors() {
+		return nil, Solution{}, diags
+	}
+
+	// call descent parser from here
+	resources, app, decodeDiags := DecodeBody(contents, "", schemas, typemap, specs, decodeOptions)
+	return resources, app, append(diags, decodeDiags...)
+}
+
+// matchCommand is the default command, which loads a solution file and matches it against the pattern library
+func matchCommand(args []string) {
+	flags := flag.NewFlagSet("design-as-code", flag.ExitOnError)
+
+	// need to get the command line parameters
+	var options reportOptions
+	options.addFlags(flags)
+	var solutionOptions solutionOptions
+	solutionOptions.addFlags(flags)
+	flags.Parse(args)
+
+	options.setLogLevel()
+
+	log.Info("Running...")
+	log.WithFields(log.Fields{
+		"patternLibraryFile": options.patternsLibraryFile,
+	}).Info("Patterns library file")
+	log.WithFields(log.Fields{
+		"solutionDescriptorFile": solutionOptions.solutionDescriptor,
+	}).Info("Solution descriptor file")
+
+	schemas, typemap, specs, hash := loadSchema()
+	options.specHash = hash
+	patterns := loadPatterns(options.patternsLibraryFile)
 
-		// call descent parser from here
-		resources, app, diagnostics := DecodeBody(contents, "", schemas, typemap)
-		if diagnostics != nil && diagnostics.HasErrors() {
-			wr.WriteDiagnostics(diagnostics)
-			log.Fatal("Unrecoverable error")
-			os.Exit(1)
+	resources, app := loadSolution(solutionOptions, schemas, typemap, specs)
+
+	writeReports(options, []solutionReport{reportSolution(resources, app, patterns, typemap, options)})
+}
+
+// writeCommand loads a solution file and writes it back out as canonical HCL, which also converts JSON and YAML
+// solutions to HCL
+func writeCommand(args []string) {
+	flags := flag.NewFlagSet("design-as-code write", flag.ExitOnError)
+	var solutionOptions solutionOptions
+	solutionOptions.addFlags(flags)
+	outFile := flags.String("out", "", "Write the solution to this file. (default stdout)")
+	debugLog := flags.Bool("debug", false, "Should we log verbose messages for debugging?")
+	flags.Parse(args)
+
+	if *debugLog {
+		log.SetLevel(log.DebugLevel)
+	}
+
+	schemas, typemap, specs, _ := loadSchema()
+	resources, app := loadSolution(solutionOptions, schemas, typemap, specs)
+
+	if *outFile == "" {
+		src, err := WriteSolution(resources, app, typemap)
+		if err != nil {
+			log.WithError(err).Fatal("Error writing solution")
 		}
+		os.Stdout.Write(src)
+		return
+	}
+	writeSolutionFile(*outFile, resources, app, typemap)
+}
+
+// writeSolutionFile writes a solution to a file as HCL
+func writeSolutionFile(filename string, resources []Resource, app Solution, typemap map[string]map[string]string) {
+	log.WithFields(log.Fields{
+		"file":  filename,
+		"count": len(resources),
+	}).Info("Writing solution")
+	src, err := WriteSolution(resources, app, typemap)
+	if err != nil {
+		log.WithError(err).Fatal("Error writing solution")
+	}
+	if err := ioutil.WriteFile(filename, src, 0644); err != nil {
+		log.WithError(err).Fatal("Error writing solution")
+	}
+}
 
+// reportSolution runs the tool mode over a loaded solution, matching it against the patterns for 'match', and returns
+// the report to write
+func reportSolution(resources []Resource, app Solution, patterns Patterns, typemap map[string]map[string]string, options reportOptions) solutionReport {
+	log.WithFields(log.Fields{
+		"count":          len(resources),
+		"solutionName":   app.solutionName,
+		"solutionNumber": app.solutionNumber,
+	}).Info("Solution loaded")
+
+	for key, value := range app.solutionMetadata {
 		log.WithFields(log.Fields{
-			"count":          len(resources),
-			"solutionName":   app.solutionName,
-			"solutionNumber": app.solutionNumber,
-		}).Info("Solution loaded")
+			"variable": key,
+			"value":    value,
+		}).Debug("Solution metadata")
+	}
 
-		for _, resource := range resources {
+	for _, resource := range resources {
+		log.WithFields(log.Fields{
+			"resourceType": resource.resourceType,
+			"resourceName": resource.resourceName,
+		}).Debug("Resource object")
+		for key, value := range resource.resourceAttributes {
 			log.WithFields(log.Fields{
-				"resourceType": resource.resourceType,
-				"resourceName": resource.resourceName,
-			}).Debug("Resource object")
-			for key, value := range resource.resourceAttributes {
-				log.WithFields(log.Fields{
-					"resource": resource.resourceType + "/" + resource.resourceName,
-					"variable": key,
-					"value":    value,
-				}).Debug("Variable on resource")
-			}
+				"resource": resourceKey(resource),
+				"variable": key,
+				"value":    value,
+			}).Debug("Variable on resource")
 		}
+	}
+
+	log.WithFields(log.Fields{
+		"mode": options.toolMode,
+	}).Info("Tool mode")
+
+	report := solutionReport{resources: resources, typemap: typemap}
+
+	if options.toolMode == "describe" {
+		log.Info("Mode is describe")
+		report.describe = true
+		report.result = BuildMatchResult(resources, app, patterns, nil, nil, typemap, options)
+		report.result.Solver = ResultSolver{}
+		log.Debug("Getting formatted data for JSON conversion")
+		report.rows = ResourcesToStringMap(resources, app)
+	}
 
+	if options.toolMode == "match" {
+		log.Info("Doing intial pattern match")
+		matched, unmatched := MatchPatternsToSolution(resources, app, patterns.PatternSet, typemap)
 		log.WithFields(log.Fields{
-			"mode": *toolMode,
-		}).Info("Tool mode")
+			"matched":   len(matched),
+			"unmatched": len(unmatched),
+		}).Info("Matched patterns")
 
-		if *jsonFileOut != "" {
-			log.WithFields(log.Fields{
-				"jsonFile": *jsonFileOut,
-			}).Info("Output mode is JSON")
-		}
+		log.WithFields(log.Fields{
+			"solveMode": options.solveMode,
+		}).Info("Running solver")
+		var solution []MatchedPattern
+		var unmatchedAfterSolution []string
 
-		if *toolMode == "describe" {
-			log.Info("Mode is describe")
-			if *jsonFileOut == "" {
-				log.Warn("Mode is 'describe', but no JSON file was specified for output")
-			} else {
-				log.Debug("Getting formatted data for JSON conversion")
-				data := ResourcesToStringMap(resources, app)
-				log.Debug("Converting data to JSON")
-				rows, err := ListToJson(data)
-				if err != nil {
-					log.WithError(err).Fatal("Error encoding JSON")
-				}
-				jsonForFile := strings.Join(rows, "\n")
-				fmt.Printf("\nJSON: \n%s\n\n", jsonForFile)
-				log.Debug("Writing to file")
-				writeErr := ioutil.WriteFile(*jsonFileOut, []byte(jsonForFile), 0644)
-				if writeErr != nil {
-					log.WithError(writeErr).Fatal("Error writing to file")
-				}
-				log.Debug("File written")
-			}
+		if options.solveMode == "priority" {
+			solution, unmatchedAfterSolution = SolveForPriority(matched, resources)
 		}
+		if options.solveMode == "max" {
+			solution, unmatchedAfterSolution = SolvForMaxCoverage(matched, resources)
+		}
+		log.WithFields(log.Fields{
+			"matched":   len(solution),
+			"unmatched": len(unmatchedAfterSolution),
+		}).Info("Solver has run")
 
-		if *toolMode == "match" {
-			log.Info("Doing intial pattern match")
-			matched, unmatched := MatchPatternsToSolution(resources, patterns.PatternSet, typemap)
-			log.WithFields(log.Fields{
-				"matched":   len(matched),
-				"unmatched": len(unmatched),
-			}).Info("Matched patterns")
-
-			log.WithFields(log.Fields{
-				"solveMode": *solveMode,
-			}).Info("Running solver")
-			var solution []MatchedPattern
-			var unmatchedAfterSolution []string
+		report.matched = solution
+		report.unmatched = unmatchedAfterSolution
+		report.result = BuildMatchResult(resources, app, patterns, solution, unmatchedAfterSolution, typemap, options)
+		log.Debug("Getting formatted data for JSON conversion")
+		report.rows = MatchedPatternsToStringMap(solution, resources, unmatchedAfterSolution, app)
+	}
 
-			if *solveMode == "priority" {
-				solution, unmatchedAfterSolution = SolveForPriority(matched, resources)
-			}
-			if *solveMode == "max" {
-				solution, unmatchedAfterSolution = SolvForMaxCoverage(matched, resources)
-			}
-			log.WithFields(log.Fields{
-				"matched":   len(solution),
-				"unmatched": len(unmatchedAfterSolution),
-			}).Info("Solver has run")
-
-			fmt.Print("\nMatched patterns\n\n")
-			PrintTextPatternTable(solution)
-
-			if len(unmatchedAfterSolution) == 0 {
-				fmt.Print("\nNo unmatched resources.\n")
-			} else {
-				fmt.Print("\nUmatched resources:\n\n")
-				PrintTextResourceTable(unmatchedAfterSolution)
-			}
+	return report
+}
 
-			// need to write to JSON if the mode is enabled
-			if *jsonFileOut != "" {
-				log.Debug("Getting formatted data for JSON conversion")
-				data := MatchedPatternsToStringMap(solution, resources, unmatchedAfterSolution, app)
-				log.Debug("Converting data to JSON")
-				rows, err := ListToJson(data)
-				if err != nil {
-					log.WithError(err).Fatal("Error encoding JSON")
-				}
-				jsonForFile := strings.Join(rows, "\n")
-				fmt.Printf("\nJSON: \n%s\n\n", jsonForFile)
-				log.Debug("Writing to file")
-				writeErr := ioutil.WriteFile(*jsonFileOut, []byte(jsonForFile), 0644)
-				if writeErr != nil {
-					log.WithError(writeErr).Fatal("Error writing to file")
-				}
-				log.Debug("File written")
-			}
+// writeReports writes the reports in the output format, or with the template, and to the JSON and result files if they
+// were asked for
+func writeReports(options reportOptions, reports []solutionReport) {
+	if options.templateFile != "" {
+		t, err := LoadTemplate(options.templateFile)
+		if err != nil {
+			log.WithError(err).Fatal("Cannot load the template")
+		}
+		if err := writeTemplateOutput(options.outputFile, t, reports); err != nil {
+			log.WithError(err).Fatal("Error writing results")
+		}
+	} else if err := writeOutput(options.outputFile, options.outputFormat, reports); err != nil {
+		log.WithError(err).Fatal("Error writing results")
+	}
 
+	if options.resultFileOut != "" {
+		log.WithFields(log.Fields{
+			"file": options.resultFileOut,
+		}).Info("Writing result")
+		if err := writeOutput(options.resultFileOut, "json", reports); err != nil {
+			log.WithError(err).Fatal("Error writing result")
 		}
+	}
 
+	if options.jsonFileOut != "" {
+		log.WithFields(log.Fields{
+			"jsonFile": options.jsonFileOut,
+		}).Info("Output mode is JSON")
+		var rows []string
+		for _, report := range reports {
+			converted, err := ListToJson(report.rows)
+			if err != nil {
+				log.WithError(err).Fatal("Error encoding JSON")
+			}
+			rows = append(rows, converted...)
+		}
+		writeJSONFile(options.jsonFileOut, rows)
 	}
+}
 
+// writeJSONFile writes the JSON rows to the file, if one was given
+func writeJSONFile(jsonFileOut string, rows []string) {
+	if jsonFileOut == "" || rows == nil {
+		return
+	}
+	log.Debug("Writing to file")
+	writeErr := ioutil.WriteFile(jsonFileOut, []byte(strings.Join(rows, "\n")), 0644)
+	if writeErr != nil {
+		log.WithError(writeErr).Fatal("Error writing to file")
+	}
+	log.Debug("File written")
 }
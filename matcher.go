@@ -2,8 +2,10 @@ package main
 
 import (
 	"fmt"
+	"os"
 	"sort"
 	"strconv"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -19,11 +21,11 @@ func SolveForPriority(matches []MatchedPattern, resources []Resource) (solution
 	// create a map to track which resources have been used
 	matchMap := make(map[string]bool)
 	for _, resource := range resources {
-		matchMap[resource.resourceType+"/"+resource.resourceName] = false
+		matchMap[resourceKey(resource)] = false
 	}
 
 	if log.GetLevel() >= log.DebugLevel {
-		fmt.Println("\nMatched patterns before sorting:")
+		fmt.Fprintln(os.Stderr, "\nMatched patterns before sorting:")
 		DebugPrintPatternTable(matches)
 	}
 
@@ -40,9 +42,9 @@ func SolveForPriority(matches []MatchedPattern, resources []Resource) (solution
 	})
 
 	if log.GetLevel() >= log.DebugLevel {
-		fmt.Println("\nMatched patterns after sorting:")
+		fmt.Fprintln(os.Stderr, "\nMatched patterns after sorting:")
 		DebugPrintPatternTable(matches)
-		fmt.Println("")
+		fmt.Fprintln(os.Stderr)
 	}
 
 	// got through the matches and select them till they are run out or we have covered all the resources
@@ -50,7 +52,7 @@ func SolveForPriority(matches []MatchedPattern, resources []Resource) (solution
 		// check that all resources are unused
 		match := true
 		for _, resource := range mp.Resources {
-			if matchMap[resource.resourceType+"/"+resource.resourceName] {
+			if matchMap[resourceKey(resource)] {
 				match = false
 			}
 		}
@@ -58,7 +60,7 @@ func SolveForPriority(matches []MatchedPattern, resources []Resource) (solution
 			solution = append(solution, mp)
 			// need to mark resources as used
 			for _, resource := range mp.Resources {
-				matchMap[resource.resourceType+"/"+resource.resourceName] = true
+				matchMap[resourceKey(resource)] = true
 			}
 		}
 	}
@@ -79,11 +81,11 @@ func SolvForMaxCoverage(matches []MatchedPattern, resources []Resource) (solutio
 	// create a map to track which resources have been used
 	matchMap := make(map[string]bool)
 	for _, resource := range resources {
-		matchMap[resource.resourceType+"/"+resource.resourceName] = false
+		matchMap[resourceKey(resource)] = false
 	}
 
 	if log.GetLevel() >= log.DebugLevel {
-		fmt.Println("\nMatched patterns before sorting:")
+		fmt.Fprintln(os.Stderr, "\nMatched patterns before sorting:")
 		DebugPrintPatternTable(matches)
 	}
 
@@ -99,9 +101,9 @@ func SolvForMaxCoverage(matches []MatchedPattern, resources []Resource) (solutio
 	})
 
 	if log.GetLevel() >= log.DebugLevel {
-		fmt.Println("\nMatched patterns after sorting:")
+		fmt.Fprintln(os.Stderr, "\nMatched patterns after sorting:")
 		DebugPrintPatternTable(matches)
-		fmt.Println("")
+		fmt.Fprintln(os.Stderr)
 	}
 
 	// got through the matches and select them till they are run out or we have covered all the resources
@@ -109,7 +111,7 @@ func SolvForMaxCoverage(matches []MatchedPattern, resources []Resource) (solutio
 		// check that all resources are unused
 		match := true
 		for _, resource := range mp.Resources {
-			if matchMap[resource.resourceType+"/"+resource.resourceName] {
+			if matchMap[resourceKey(resource)] {
 				match = false
 			}
 		}
@@ -117,7 +119,7 @@ func SolvForMaxCoverage(matches []MatchedPattern, resources []Resource) (solutio
 			solution = append(solution, mp)
 			// need to mark resources as used
 			for _, resource := range mp.Resources {
-				matchMap[resource.resourceType+"/"+resource.resourceName] = true
+				matchMap[resourceKey(resource)] = true
 			}
 		}
 	}
@@ -146,16 +148,31 @@ func CheckRelation(actualValue interface{}, expectedValue string, operator strin
 		"type":     expectedType,
 		"operator": operator,
 	}).Trace("Starting check relation")
+	// the value is only checked once the attribute is known to be set, so it is defined whatever its type
+	if operator == "defined" {
+		return true
+	}
 	switch expectedType {
-	case "string":
+	case "string", "enum":
 		actual := actualValue.(string)
 		switch operator {
+		case "in":
+			for _, expected := range splitValueList(expectedValue) {
+				if actual == expected {
+					return true
+				}
+			}
+			return false
 		case "eq":
 			return actual == expectedValue
 		case "lt":
 			return actual < expectedValue
+		case "lte":
+			return actual <= expectedValue
 		case "gt":
 			return actual > expectedValue
+		case "gte":
+			return actual >= expectedValue
 		default:
 			log.Trace("No valid operator provided")
 			return false
@@ -166,6 +183,14 @@ func CheckRelation(actualValue interface{}, expectedValue string, operator strin
 		return actual == expected
 	case "int":
 		actual := actualValue.(int)
+		if operator == "in" {
+			for _, value := range splitValueList(expectedValue) {
+				if strconv.Itoa(actual) == value {
+					return true
+				}
+			}
+			return false
+		}
 		expected, err := strconv.Atoi(expectedValue)
 		if err != nil {
 			log.WithError(err).Error("Failed to convert string to integer")
@@ -176,22 +201,313 @@ func CheckRelation(actualValue interface{}, expectedValue string, operator strin
 			return actual == expected
 		case "lt":
 			return actual < expected
+		case "lte":
+			return actual <= expected
 		case "gt":
 			return actual > expected
+		case "gte":
+			return actual >= expected
 		default:
 			log.Trace("No valid operator provided")
 			return false
 		}
+	case "float":
+		return compareNumbers(actualValue.(float64), expectedValue, operator)
+	case "list(string)":
+		if operator != "contains" {
+			log.Trace("Lists only support the contains operator")
+			return false
+		}
+		for _, actual := range actualValue.([]string) {
+			if actual == expectedValue {
+				return true
+			}
+		}
+		return false
+	case "list(int)":
+		if operator != "contains" {
+			log.Trace("Lists only support the contains operator")
+			return false
+		}
+		expected, err := strconv.Atoi(expectedValue)
+		if err != nil {
+			log.WithError(err).Error("Failed to convert string to integer")
+			return false
+		}
+		for _, actual := range actualValue.([]int) {
+			if actual == expected {
+				return true
+			}
+		}
+		return false
+	case "map(string)":
+		if operator != "contains" {
+			log.Trace("Maps only support the contains operator")
+			return false
+		}
+		_, present := actualValue.(map[string]string)[expectedValue]
+		return present
 	}
 	log.Trace("No valid type provided")
 	return false
 }
 
-func MatchPatternsToSolution(resources []Resource, patterns []Pattern, typemap map[string]map[string]string) (matched []MatchedPattern, unmatched []string) {
+// splitValueList splits the comma separated list of values used by the 'in' operator
+func splitValueList(in string) []string {
+	var out []string
+	for _, value := range strings.Split(in, ",") {
+		out = append(out, strings.TrimSpace(value))
+	}
+	return out
+}
+
+// CheckLinks returns true if the resource has at least one link which satisfies the link rule
+func CheckLinks(resource Resource, linkRule LinkRule, typemap map[string]map[string]string) bool {
+	for _, link := range resource.resourceLinks {
+		if linkRule.TargetType != "" && link.targetType != linkRule.TargetType {
+			continue
+		}
+		match := true
+		for _, condition := range linkRule.Conditions {
+			var actualValue interface{}
+			var present bool
+			vtype := typemap["link"][condition.Attribute]
+			// the target is not in the spec, it is always the address of the resource linked to
+			if condition.Attribute == "target" {
+				actualValue, present, vtype = link.target, true, "string"
+			} else {
+				actualValue, present = link.relationshipAttributes[condition.Attribute]
+			}
+			if !present || !CheckRelation(actualValue, condition.Value, condition.Operator, vtype) {
+				match = false
+			}
+		}
+		if match {
+			log.WithFields(log.Fields{
+				"source": link.source,
+				"target": link.target,
+			}).Trace("Link matches link rule")
+			return true
+		}
+	}
+	return false
+}
+
+// toFloat converts the numeric attribute values we decode into a float64 so they can be aggregated
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// compareNumbers compares an actual number with the expected value from a pattern using the operator specified
+func compareNumbers(actual float64, expectedValue string, operator string) bool {
+	expected, err := strconv.ParseFloat(expectedValue, 64)
+	if err != nil {
+		log.WithError(err).Error("Failed to convert string to number")
+		return false
+	}
+	switch operator {
+	case "eq":
+		return actual == expected
+	case "lt":
+		return actual < expected
+	case "lte":
+		return actual <= expected
+	case "gt":
+		return actual > expected
+	case "gte":
+		return actual >= expected
+	default:
+		log.Trace("No valid operator provided")
+		return false
+	}
+}
+
+// CheckAggregate evaluates a single aggregate condition against the set of resources matched by a rule
+func CheckAggregate(resources []Resource, aggregate Aggregate, typemap map[string]map[string]string) bool {
+	log.WithFields(log.Fields{
+		"function":  aggregate.Function,
+		"attribute": aggregate.Attribute,
+		"operator":  aggregate.Operator,
+		"value":     aggregate.Value,
+		"resources": len(resources),
+	}).Trace("Starting check aggregate")
+
+	if aggregate.Function == "count" {
+		return compareNumbers(float64(len(resources)), aggregate.Value, aggregate.Operator)
+	}
+
+	// every other function works over the values of an attribute, resources which don't have the attribute fail the aggregate
+	var values []interface{}
+	for _, resource := range resources {
+		value, _, present := LookupAttribute(resource.resourceAttributes, resource.resourceType, aggregate.Attribute, typemap)
+		if !present {
+			log.WithFields(log.Fields{
+				"resource":  resourceKey(resource),
+				"attribute": aggregate.Attribute,
+			}).Trace("Resource is missing attribute used in aggregate")
+			return false
+		}
+		values = append(values, value)
+	}
+
+	if aggregate.Function == "same" {
+		for _, value := range values[1:] {
+			if fmt.Sprint(value) != fmt.Sprint(values[0]) {
+				return false
+			}
+		}
+		return true
+	}
+
+	var numbers []float64
+	for _, value := range values {
+		number, ok := toFloat(value)
+		if !ok {
+			log.WithFields(log.Fields{
+				"attribute": aggregate.Attribute,
+				"function":  aggregate.Function,
+			}).Error("Aggregate function needs a numeric attribute")
+			return false
+		}
+		numbers = append(numbers, number)
+	}
+
+	var result float64
+	switch aggregate.Function {
+	case "sum", "avg":
+		for _, number := range numbers {
+			result = result + number
+		}
+		if aggregate.Function == "avg" {
+			result = result / float64(len(numbers))
+		}
+	case "min":
+		result = numbers[0]
+		for _, number := range numbers[1:] {
+			if number < result {
+				result = number
+			}
+		}
+	case "max":
+		result = numbers[0]
+		for _, number := range numbers[1:] {
+			if number > result {
+				result = number
+			}
+		}
+	default:
+		log.WithFields(log.Fields{
+			"function": aggregate.Function,
+		}).Error("Unknown aggregate function")
+		return false
+	}
+
+	return compareNumbers(result, aggregate.Value, aggregate.Operator)
+}
+
+// CheckAggregates returns true only if all the aggregates hold for the set of resources
+func CheckAggregates(resources []Resource, aggregates []Aggregate, typemap map[string]map[string]string) bool {
+	for _, aggregate := range aggregates {
+		if !CheckAggregate(resources, aggregate, typemap) {
+			return false
+		}
+	}
+	return true
+}
+
+// LookupAttribute finds the value and type of an attribute, the attribute can be a path into nested blocks or maps,
+// e.g. sla.rpo or tags.environment
+func LookupAttribute(attributes map[string]interface{}, blockType string, path string, typemap map[string]map[string]string) (interface{}, string, bool) {
+	parts := strings.Split(path, ".")
+	for i, part := range parts {
+		value, present := attributes[part]
+		if !present {
+			return nil, "", false
+		}
+		attributeType := typemap[blockType][part]
+		if i == len(parts)-1 {
+			return value, attributeType, true
+		}
+		switch attributeType {
+		case "block":
+			attributes = value.(map[string]interface{})
+			blockType = part
+		case "map(string)":
+			// the rest of the path is the key, which could itself contain dots
+			value, present := value.(map[string]string)[strings.Join(parts[i+1:], ".")]
+			return value, "string", present
+		default:
+			return nil, "", false
+		}
+	}
+	return nil, "", false
+}
+
+// attributeType returns the type of an attribute, which can be a path into nested blocks or maps
+func attributeType(blockType string, path string, typemap map[string]map[string]string) string {
+	parts := strings.Split(path, ".")
+	for i, part := range parts {
+		vtype := typemap[blockType][part]
+		if i == len(parts)-1 {
+			return vtype
+		}
+		switch vtype {
+		case "block":
+			blockType = part
+		case "map(string)":
+			return "string"
+		default:
+			return ""
+		}
+	}
+	return ""
+}
+
+// CheckCondition returns true if the condition holds for the resource, a resource which does not have the attribute
+// never satisfies the condition
+func CheckCondition(resource Resource, condition Condition, typemap map[string]map[string]string) bool {
+	actualValue, expectedType, present := LookupAttribute(resource.resourceAttributes, resource.resourceType, condition.Attribute, typemap)
+	if !present {
+		return false
+	}
+	return CheckRelation(actualValue, condition.Value, condition.Operator, expectedType)
+}
+
+// CheckSolution returns true if all the conditions hold for the solution
+func CheckSolution(solution Solution, solutionRule *SolutionRule, typemap map[string]map[string]string) bool {
+	for _, condition := range solutionRule.Conditions {
+		var actualValue interface{}
+		var expectedType string
+		var present bool
+		switch condition.Attribute {
+		case "solution_name":
+			actualValue, expectedType, present = solution.solutionName, "string", true
+		case "solution_number":
+			actualValue, expectedType, present = solution.solutionNumber, "string", true
+		default:
+			actualValue, expectedType, present = LookupAttribute(solution.solutionMetadata, "metadata", condition.Attribute, typemap)
+		}
+		if !present || !CheckRelation(actualValue, condition.Value, condition.Operator, expectedType) {
+			log.WithFields(log.Fields{
+				"attribute": condition.Attribute,
+			}).Trace("Solution condition does not hold")
+			return false
+		}
+	}
+	return true
+}
+
+func MatchPatternsToSolution(resources []Resource, solution Solution, patterns []Pattern, typemap map[string]map[string]string) (matched []MatchedPattern, unmatched []string) {
 
 	matchMap := make(map[string]bool)
 	for _, resource := range resources {
-		matchMap[resource.resourceType+"/"+resource.resourceName] = false
+		matchMap[resourceKey(resource)] = false
 	}
 
 	for _, pattern := range patterns {
@@ -199,6 +515,14 @@ func MatchPatternsToSolution(resources []Resource, patterns []Pattern, typemap m
 			"pattern": pattern.PatternName,
 		}).Debug("Attempting to match pattern")
 
+		// patterns can be limited to solutions with particular metadata
+		if pattern.Solution != nil && !CheckSolution(solution, pattern.Solution, typemap) {
+			log.WithFields(log.Fields{
+				"pattern": pattern.PatternName,
+			}).Debug("Pattern does not apply to this solution")
+			continue
+		}
+
 		var mp MatchedPattern
 		var mr []Resource
 
@@ -212,6 +536,7 @@ func MatchPatternsToSolution(resources []Resource, patterns []Pattern, typemap m
 				"resource": rule.Resource,
 			}).Debug("Working on rule for resource")
 			matchingResources := 0
+			var ruleResources []Resource
 
 			for _, resource := range resources {
 				match := true
@@ -225,33 +550,27 @@ func MatchPatternsToSolution(resources []Resource, patterns []Pattern, typemap m
 							"pattern":       pattern.PatternName,
 							"resource":      rule.Resource,
 							"attribute":     condition.Attribute,
-							"attributeType": typemap[resource.resourceType][condition.Attribute],
+							"attributeType": attributeType(resource.resourceType, condition.Attribute, typemap),
 							"operator":      condition.Operator,
 							"value":         condition.Value,
 						}).Debug("Checking condition")
 
-						// does the the resource have the attributes the rule expects?
-						_, present := resource.resourceAttributes[condition.Attribute]
-						if present {
-							// get the values into variables with shorter names
-							expectedValue := condition.Value
-							actualValue := resource.resourceAttributes[condition.Attribute]
-
-							// check if the actual value matches the current value using the operator specified by the rule
-							// TODO: implement additional operators: gte, lte, link
-
-							expectedType := typemap[resource.resourceType][condition.Attribute]
-							if CheckRelation(actualValue, expectedValue, condition.Operator, expectedType) {
-								log.Trace("Back from check relation with a +ve match")
-								match = SetTrueIfNotFalse(match)
-								conditionCount = conditionCount + 1
-							} else {
-								log.Trace("Back from check relation with a -ve match")
-								match = false
-							}
+						// check if the actual value matches the current value using the operator specified by the rule
+						if CheckCondition(resource, condition, typemap) {
+							log.Trace("Back from check relation with a +ve match")
+							match = SetTrueIfNotFalse(match)
+							conditionCount = conditionCount + 1
+						} else {
+							log.Trace("Back from check relation with a -ve match")
+							match = false
+						}
+					}
 
+					// run through the link rules, each one needs a link from this resource which satisfies it
+					for _, linkRule := range rule.Links {
+						if CheckLinks(resource, linkRule, typemap) {
+							conditionCount = conditionCount + 1
 						} else {
-							// attribute is not present for this resource, so this is an automatic no match
 							match = false
 						}
 					}
@@ -261,13 +580,31 @@ func MatchPatternsToSolution(resources []Resource, patterns []Pattern, typemap m
 
 				// does the resource match?
 				if match {
-					matchingResources = matchingResources + 1
-					mr = append(mr, resource)
+					ruleResources = append(ruleResources, resource)
+				}
+
+			}
 
-					// update the matchmap to show which resources were matched
-					matchMap[resource.resourceType+"/"+resource.resourceName] = true
+			// aggregates are checked over the set of resources this rule matched, if any of them fail then
+			// the rule does not match at all
+			if len(ruleResources) > 0 && len(rule.Aggregates) > 0 {
+				if CheckAggregates(ruleResources, rule.Aggregates, typemap) {
+					conditionCount = conditionCount + len(rule.Aggregates)
+				} else {
+					log.WithFields(log.Fields{
+						"pattern":  pattern.PatternName,
+						"resource": rule.Resource,
+					}).Debug("Aggregate conditions failed for rule")
+					ruleResources = nil
 				}
+			}
+
+			for _, resource := range ruleResources {
+				matchingResources = matchingResources + 1
+				mr = append(mr, resource)
 
+				// update the matchmap to show which resources were matched
+				matchMap[resourceKey(resource)] = true
 			}
 
 			if matchingResources > 0 {
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/zclconf/go-cty/cty"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// moduleSchema is the schema for the files in a module, these are like a solution but without the solution
+// attributes, and they can have outputs
+var moduleSchema = &hcl.BodySchema{
+	Blocks: []hcl.BlockHeaderSchema{
+		{
+			Type:       "resource",
+			LabelNames: []string{"type", "name"},
+		},
+		{
+			Type:       "variable",
+			LabelNames: []string{"name"},
+		},
+		{
+			Type: "locals",
+		},
+		{
+			Type:       "module",
+			LabelNames: []string{"name"},
+		},
+		{
+			Type:       "output",
+			LabelNames: []string{"name"},
+		},
+	},
+}
+
+var outputBlockSchema = &hcl.BodySchema{
+	Attributes: []hcl.AttributeSchema{
+		{
+			Name:     "value",
+			Required: true,
+		},
+		{
+			Name:     "description",
+			Required: false,
+		},
+	},
+}
+
+// moduleInput is a value passed to a module from the module block, which sets one of the module's variables
+type moduleInput struct {
+	value   cty.Value
+	subject hcl.Range
+}
+
+// decodeModules decodes each of the module blocks, the resources in a module have addresses under the module's path,
+// e.g. module.web.server.ui.  It returns the resources from all of the modules, and the outputs of each module keyed
+// by the name of the module so they can be referred to as module.<name>.<output>.
+func decodeModules(blocks hcl.Blocks, parentPath string, ctx *hcl.EvalContext, options DecodeOptions, state *decodeState) ([]Resource, map[string]cty.Value, hcl.Diagnostics) {
+	var resources []Resource
+	var diags hcl.Diagnostics
+	outputs := make(map[string]cty.Value)
+
+	for _, block := range blocks {
+		name := block.Labels[0]
+		modulePath := "module." + name
+		if parentPath != "" {
+			modulePath = parentPath + "." + modulePath
+		}
+
+		if _, present := outputs[name]; present {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Duplicate module",
+				Detail:   fmt.Sprintf("A module named \"%s\" has already been declared.", name),
+				Subject:  block.DefRange.Ptr(),
+			})
+			continue
+		}
+
+		attributes, diag := block.Body.JustAttributes()
+		diags = append(diags, diag...)
+		if diag.HasErrors() {
+			continue
+		}
+
+		sourceAttr, present := attributes["source"]
+		if !present {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Missing required argument",
+				Detail:   "The argument \"source\" is required, it should be the path to the directory containing the module.",
+				Subject:  block.DefRange.Ptr(),
+			})
+			continue
+		}
+		val, diag := sourceAttr.Expr.Value(ctx)
+		diags = append(diags, diag...)
+		if diag.HasErrors() {
+			continue
+		}
+		if val.IsNull() || val.Type() != cty.String {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid module source",
+				Detail:   "The source of a module must be a string.",
+				Subject:  sourceAttr.Expr.Range().Ptr(),
+			})
+			continue
+		}
+		source := val.AsString()
+		if !filepath.IsAbs(source) {
+			source = filepath.Join(options.BaseDirectory, source)
+		}
+		source = filepath.Clean(source)
+
+		if containsString(state.moduleSources, source) {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Module cycle",
+				Detail:   fmt.Sprintf("The module at %s uses itself, either directly or through other modules.", source),
+				Subject:  sourceAttr.Expr.Range().Ptr(),
+			})
+			continue
+		}
+
+		// everything apart from the source is an input to the module
+		inputs := make(map[string]moduleInput)
+		for inputName, attribute := range attributes {
+			if inputName == "source" {
+				continue
+			}
+			val, diag := attribute.Expr.Value(ctx)
+			diags = append(diags, diag...)
+			if !diag.HasErrors() {
+				inputs[inputName] = moduleInput{
+					value:   val,
+					subject: attribute.Expr.Range(),
+				}
+			}
+		}
+
+		log.WithFields(log.Fields{
+			"module": modulePath,
+			"source": source,
+			"inputs": len(inputs),
+		}).Debug("Loading module")
+
+		content, diag := loadModule(source, options.Parser, sourceAttr.Expr.Range())
+		diags = append(diags, diag...)
+		if diag.HasErrors() {
+			continue
+		}
+
+		moduleOptions := DecodeOptions{
+			ExpandInstances: options.ExpandInstances,
+			BaseDirectory:   source,
+			Parser:          options.Parser,
+			inputs:          inputs,
+		}
+		moduleCtx, diag := DecodeVariables(content, moduleOptions)
+		diags = append(diags, diag...)
+		if diag.HasErrors() {
+			continue
+		}
+
+		state.moduleSources = append(state.moduleSources, source)
+		moduleResources, moduleCtx, diag := decodeResources(content, modulePath, moduleCtx, moduleOptions, state)
+		state.moduleSources = state.moduleSources[:len(state.moduleSources)-1]
+		diags = append(diags, diag...)
+		resources = append(resources, moduleResources...)
+
+		moduleOutputs := make(map[string]cty.Value)
+		for _, outputBlock := range content.Blocks.OfType("output") {
+			outputContent, diag := outputBlock.Body.Content(outputBlockSchema)
+			diags = append(diags, diag...)
+			if diag.HasErrors() {
+				continue
+			}
+			val, diag := outputContent.Attributes["value"].Expr.Value(moduleCtx)
+			diags = append(diags, diag...)
+			moduleOutputs[outputBlock.Labels[0]] = val
+		}
+		outputs[name] = cty.ObjectVal(moduleOutputs)
+	}
+
+	return resources, outputs, diags
+}
+
+// loadModule reads all the .hcl and .hcl.json files in the module's directory
+func loadModule(directory string, parser *hclparse.Parser, subject hcl.Range) (*hcl.BodyContent, hcl.Diagnostics) {
+	if parser == nil {
+		parser = hclparse.NewParser()
+	}
+
+	filenames, _ := filepath.Glob(filepath.Join(directory, "*.hcl"))
+	jsonFilenames, _ := filepath.Glob(filepath.Join(directory, "*.hcl.json"))
+	filenames = append(filenames, jsonFilenames...)
+	if len(filenames) == 0 {
+		return nil, hcl.Diagnostics{
+			{
+				Severity: hcl.DiagError,
+				Summary:  "Module not found",
+				Detail:   fmt.Sprintf("There are no .hcl or .hcl.json files in %s.", directory),
+				Subject:  subject.Ptr(),
+			},
+		}
+	}
+	sort.Strings(filenames)
+
+	var diags hcl.Diagnostics
+	var files []*hcl.File
+	for _, filename := range filenames {
+		file, diag := ParseSolutionFile(parser, filename)
+		diags = append(diags, diag...)
+		if file != nil {
+			files = append(files, file)
+		}
+	}
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	content, diag := hcl.MergeFiles(files).Content(moduleSchema)
+	diags = append(diags, diag...)
+	return content, diags
+}
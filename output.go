@@ -1,13 +1,171 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/jedib0t/go-pretty/v6/table"
+	"gopkg.in/yaml.v3"
 )
 
+// outputFormats are the formats the results of matching can be written in
+var outputFormats = map[string]bool{
+	"table":    true,
+	"json":     true,
+	"ndjson":   true,
+	"yaml":     true,
+	"csv":      true,
+	"markdown": true,
+	"xlsx":     true,
+}
+
+// solutionReport is the outcome of running the tool mode over one solution, ready to be written in any of the
+// output formats.  In describe mode there are no matched patterns and every resource is listed.
+type solutionReport struct {
+	describe  bool
+	resources []Resource
+	matched   []MatchedPattern
+	unmatched []string
+	typemap   map[string]map[string]string
+	result    MatchResult
+	rows      []map[string]interface{}
+}
+
+// WriteReports writes the reports in one of the output formats.  When there is more than one solution, as there can be
+// when importing, the JSON documents follow each other, the YAML documents are separated by ---, and the CSV has a
+// single header, as does each sheet of the workbook.
+func WriteReports(w io.Writer, format string, reports []solutionReport) error {
+	switch format {
+	case "table", "markdown":
+		for _, report := range reports {
+			writeReportTables(w, report, len(reports) > 1, format == "markdown")
+		}
+		return nil
+	case "json":
+		for _, report := range reports {
+			if err := writeJSONDocument(w, report.result); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "ndjson":
+		for _, report := range reports {
+			rows, err := ListToJson(report.rows)
+			if err != nil {
+				return err
+			}
+			for _, row := range rows {
+				fmt.Fprintln(w, row)
+			}
+		}
+		return nil
+	case "yaml":
+		encoder := yaml.NewEncoder(w)
+		encoder.SetIndent(2)
+		for _, report := range reports {
+			node, err := yamlDocument(report.result)
+			if err != nil {
+				return err
+			}
+			if err := encoder.Encode(node); err != nil {
+				return err
+			}
+		}
+		return encoder.Close()
+	case "csv":
+		return writeReportCSV(w, reports)
+	case "xlsx":
+		return writeWorkbook(w, reports)
+	}
+	return fmt.Errorf("unknown output format '%s'", format)
+}
+
+// writeReportTables writes the matched patterns and unmatched resources as tables, or the resources in describe mode
+func writeReportTables(w io.Writer, report solutionReport, heading bool, markdown bool) {
+	title := func(text string) {
+		if markdown {
+			fmt.Fprintf(w, "\n%s %s\n\n", strings.Repeat("#", 2+boolToInt(heading)), text)
+		} else {
+			fmt.Fprintf(w, "\n%s\n\n", text)
+		}
+	}
+	if heading {
+		if markdown {
+			fmt.Fprintf(w, "\n## %s\n", report.result.Solution.Name)
+		} else {
+			fmt.Fprintf(w, "\nSolution %s\n", report.result.Solution.Name)
+		}
+	}
+
+	if report.describe {
+		title("Resources")
+		var keys []string
+		for _, resource := range report.resources {
+			keys = append(keys, resourceKey(resource))
+		}
+		PrintTextResourceTable(w, keys, report.resources, markdown)
+		return
+	}
+
+	title("Matched patterns")
+	PrintTextPatternTable(w, report.matched, markdown)
+
+	if len(report.unmatched) == 0 {
+		fmt.Fprint(w, "\nNo unmatched resources.\n")
+	} else {
+		title("Unmatched resources")
+		PrintTextResourceTable(w, report.unmatched, report.resources, markdown)
+	}
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// yamlDocument converts a document to YAML with the same keys, in the same order, as its JSON
+func yamlDocument(document interface{}) (*yaml.Node, error) {
+	src, err := json.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+	var node yaml.Node
+	if err := yaml.Unmarshal(src, &node); err != nil {
+		return nil, err
+	}
+	// JSON is read as flow style YAML with quoted strings, so reset the styles to get block style YAML
+	var reset func(n *yaml.Node)
+	reset = func(n *yaml.Node) {
+		n.Style = 0
+		for _, child := range n.Content {
+			reset(child)
+		}
+	}
+	reset(&node)
+	return &node, nil
+}
+
+// writeOutput writes the reports to a file, or to stdout if the file is empty
+func writeOutput(file string, format string, reports []solutionReport) error {
+	if file == "" {
+		return WriteReports(os.Stdout, format, reports)
+	}
+	var buf bytes.Buffer
+	if err := WriteReports(&buf, format, reports); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, buf.Bytes(), 0644)
+}
+
 func MatchedPatternsToStringMap(matches []MatchedPattern, resources []Resource, unmatched []string, solution Solution) (out []map[string]interface{}) {
 	version := time.Now().Unix()
 	// deal with the matches first
@@ -16,24 +174,19 @@ func MatchedPatternsToStringMap(matches []MatchedPattern, resources []Resource,
 			resourceMap := make(map[string]interface{})
 			resourceMap["solutionName"] = solution.solutionName
 			resourceMap["solutionNumber"] = solution.solutionNumber
+			if solution.solutionMetadata != nil {
+				resourceMap["solutionMetadata"] = solution.solutionMetadata
+			}
 			resourceMap["version"] = version
 			resourceMap["resourceName"] = resource.resourceName
 			resourceMap["resourceType"] = resource.resourceType
+			if resource.resourceModule != "" {
+				resourceMap["resourceModule"] = resource.resourceModule
+			}
 			resourceMap["patternName"] = match.Pattern.PatternName
 			resourceMap["patternTarget"] = match.Pattern.Target
 			resourceMap["matchesPattern"] = true
-			attributes := make([]map[string]interface{}, 0)
-			for attributeName, attributeValue := range resource.resourceAttributes {
-				if attributeName != "depends_on" {
-					attribute := make(map[string]interface{})
-					attribute["name"] = attributeName
-					attribute["value"] = attributeValue
-					attributes = append(attributes, attribute)
-				} else {
-					resourceMap["dependsOn"] = attributeValue
-				}
-			}
-			resourceMap["attributes"] = attributes
+			AddResourceAttributes(resourceMap, resource)
 			out = append(out, resourceMap)
 		}
 	}
@@ -45,27 +198,22 @@ func MatchedPatternsToStringMap(matches []MatchedPattern, resources []Resource,
 	}
 	for _, resource := range resources {
 		// check if resource is unmatched
-		_, present := unmatchedMap[resource.resourceType+"/"+resource.resourceName]
+		_, present := unmatchedMap[resourceKey(resource)]
 		if present {
 			resourceMap := make(map[string]interface{})
 			resourceMap["solutionName"] = solution.solutionName
 			resourceMap["solutionNumber"] = solution.solutionNumber
+			if solution.solutionMetadata != nil {
+				resourceMap["solutionMetadata"] = solution.solutionMetadata
+			}
 			resourceMap["version"] = version
 			resourceMap["resourceName"] = resource.resourceName
 			resourceMap["resourceType"] = resource.resourceType
-			resourceMap["matchesPattern"] = false
-			attributes := make([]map[string]interface{}, 0)
-			for attributeName, attributeValue := range resource.resourceAttributes {
-				if attributeName != "depends_on" {
-					attribute := make(map[string]interface{})
-					attribute["name"] = attributeName
-					attribute["value"] = attributeValue
-					attributes = append(attributes, attribute)
-				} else {
-					resourceMap["dependsOn"] = attributeValue
-				}
+			if resource.resourceModule != "" {
+				resourceMap["resourceModule"] = resource.resourceModule
 			}
-			resourceMap["attributes"] = attributes
+			resourceMap["matchesPattern"] = false
+			AddResourceAttributes(resourceMap, resource)
 			out = append(out, resourceMap)
 		}
 	}
@@ -73,6 +221,50 @@ func MatchedPatternsToStringMap(matches []MatchedPattern, resources []Resource,
 	return
 }
 
+// AddResourceAttributes adds the attributes of a resource to the map which will be converted to JSON, depends_on,
+// tags and description are pulled out of the attributes so they are easy to query
+func AddResourceAttributes(resourceMap map[string]interface{}, resource Resource) {
+	attributes := make([]map[string]interface{}, 0)
+	for attributeName, attributeValue := range resource.resourceAttributes {
+		switch attributeName {
+		case "depends_on":
+			resourceMap["dependsOn"] = attributeValue
+		case "tags":
+			resourceMap["tags"] = attributeValue
+		case "description":
+			resourceMap["description"] = attributeValue
+		default:
+			attribute := make(map[string]interface{})
+			attribute["name"] = attributeName
+			attribute["value"] = attributeValue
+			attributes = append(attributes, attribute)
+		}
+	}
+	resourceMap["attributes"] = attributes
+	if len(resource.resourceLinks) > 0 {
+		resourceMap["links"] = LinksToStringMap(resource.resourceLinks)
+	}
+}
+
+// LinksToStringMap converts the links from a resource into a form which can be converted to JSON
+func LinksToStringMap(links []Relationship) (out []map[string]interface{}) {
+	for _, link := range links {
+		linkMap := make(map[string]interface{})
+		linkMap["target"] = link.target
+		linkMap["targetType"] = link.targetType
+		attributes := make([]map[string]interface{}, 0)
+		for attributeName, attributeValue := range link.relationshipAttributes {
+			attribute := make(map[string]interface{})
+			attribute["name"] = attributeName
+			attribute["value"] = attributeValue
+			attributes = append(attributes, attribute)
+		}
+		linkMap["attributes"] = attributes
+		out = append(out, linkMap)
+	}
+	return
+}
+
 func ListToJson(in []map[string]interface{}) ([]string, error) {
 	var rows []string
 	for _, row := range in {
@@ -91,29 +283,26 @@ func ResourcesToStringMap(resources []Resource, solution Solution) (out []map[st
 		resourceMap := make(map[string]interface{})
 		resourceMap["solutionName"] = solution.solutionName
 		resourceMap["solutionNumber"] = solution.solutionNumber
+		if solution.solutionMetadata != nil {
+			resourceMap["solutionMetadata"] = solution.solutionMetadata
+		}
 		resourceMap["version"] = version
 		resourceMap["resourceName"] = resource.resourceName
 		resourceMap["resourceType"] = resource.resourceType
-		attributes := make([]map[string]interface{}, 0)
-		for attributeName, attributeValue := range resource.resourceAttributes {
-			if attributeName != "depends_on" {
-				attribute := make(map[string]interface{})
-				attribute["name"] = attributeName
-				attribute["value"] = attributeValue
-				attributes = append(attributes, attribute)
-			} else {
-				resourceMap["dependsOn"] = attributeValue
-			}
+		if resource.resourceModule != "" {
+			resourceMap["resourceModule"] = resource.resourceModule
 		}
-		resourceMap["attributes"] = attributes
+		AddResourceAttributes(resourceMap, resource)
 		out = append(out, resourceMap)
 	}
 	return
 }
 
+// DebugPrintPatternTable writes the matched patterns with the scores the solvers use to stderr, so it does not get
+// mixed up with the results
 func DebugPrintPatternTable(matched []MatchedPattern) {
 	t := table.NewWriter()
-	t.SetOutputMirror(os.Stdout)
+	t.SetOutputMirror(os.Stderr)
 	t.AppendHeader(table.Row{"#", "Pattern", "Resource Count", "Weight", "Condition Count"})
 	for i, pattern := range matched {
 		t.AppendRow(table.Row{
@@ -127,14 +316,14 @@ func DebugPrintPatternTable(matched []MatchedPattern) {
 	t.Render()
 }
 
-func PrintTextPatternTable(matched []MatchedPattern) {
+func PrintTextPatternTable(w io.Writer, matched []MatchedPattern, markdown bool) {
 	t := table.NewWriter()
-	t.SetOutputMirror(os.Stdout)
+	t.SetOutputMirror(w)
 	t.AppendHeader(table.Row{"#", "Pattern", "Target", "Resources"})
 	for i, pattern := range matched {
 		var resources = ""
 		for _, resource := range pattern.Resources {
-			resources = resources + resource.resourceType + "/" + resource.resourceName + ", "
+			resources = resources + resourceKey(resource) + ", "
 		}
 		t.AppendRow(table.Row{
 			i,
@@ -143,18 +332,44 @@ func PrintTextPatternTable(matched []MatchedPattern) {
 			resources[:len(resources)-2],
 		})
 	}
-	t.Render()
+	renderTable(t, markdown)
 }
 
-func PrintTextResourceTable(unmatched []string) {
+func PrintTextResourceTable(w io.Writer, unmatched []string, resources []Resource, markdown bool) {
+	byKey := make(map[string]Resource)
+	for _, resource := range resources {
+		byKey[resourceKey(resource)] = resource
+	}
+
 	t := table.NewWriter()
-	t.SetOutputMirror(os.Stdout)
-	t.AppendHeader(table.Row{"#", "Resource"})
+	t.SetOutputMirror(w)
+	t.AppendHeader(table.Row{"#", "Resource", "Tags"})
 	for i, resource := range unmatched {
 		t.AppendRow(table.Row{
 			i,
 			resource,
+			FormatTags(byKey[resource]),
 		})
 	}
+	renderTable(t, markdown)
+}
+
+// renderTable renders a table as text, or as Markdown
+func renderTable(t table.Writer, markdown bool) {
+	if markdown {
+		t.RenderMarkdown()
+		return
+	}
 	t.Render()
 }
+
+// FormatTags returns the tags of a resource as a sorted list of key=value pairs
+func FormatTags(resource Resource) string {
+	tags, _ := resource.resourceAttributes["tags"].(map[string]string)
+	var pairs []string
+	for key, value := range tags {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclparse"
+	"gopkg.in/yaml.v3"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ParseSolutionFile parses a solution (or module, or variable) file using the syntax which matches the file's
+// extension: .json files use the JSON syntax for HCL, .yml and .yaml files use YAML with the same structure as the
+// JSON syntax, and anything else is native HCL
+func ParseSolutionFile(p *hclparse.Parser, filename string) (*hcl.File, hcl.Diagnostics) {
+	switch {
+	case strings.HasSuffix(filename, ".json"):
+		log.WithFields(log.Fields{
+			"file": filename,
+		}).Debug("Parsing file as JSON")
+		return p.ParseJSONFile(filename)
+	case strings.HasSuffix(filename, ".yml"), strings.HasSuffix(filename, ".yaml"):
+		log.WithFields(log.Fields{
+			"file": filename,
+		}).Debug("Parsing file as YAML")
+		return parseYAMLFile(p, filename)
+	default:
+		return p.ParseHCLFile(filename)
+	}
+}
+
+// parseYAMLFile reads a YAML file and converts it to JSON, which is then parsed using the JSON syntax for HCL, so
+// the YAML is decoded in exactly the same way as a JSON file.  The positions in any diagnostics refer to the JSON.
+func parseYAMLFile(p *hclparse.Parser, filename string) (*hcl.File, hcl.Diagnostics) {
+	if file, present := p.Files()[filename]; present {
+		return file, nil
+	}
+
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, hcl.Diagnostics{
+			{
+				Severity: hcl.DiagError,
+				Summary:  "Failed to read file",
+				Detail:   fmt.Sprintf("The file %q could not be read: %v.", filename, err),
+			},
+		}
+	}
+
+	var data interface{}
+	if err := yaml.Unmarshal(src, &data); err != nil {
+		return nil, hcl.Diagnostics{
+			{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid YAML",
+				Detail:   fmt.Sprintf("The file %q is not valid YAML: %v.", filename, err),
+			},
+		}
+	}
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+
+	converted, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return nil, hcl.Diagnostics{
+			{
+				Severity: hcl.DiagError,
+				Summary:  "Unsupported YAML",
+				Detail:   fmt.Sprintf("The file %q cannot be converted to JSON, all the keys must be strings: %v.", filename, err),
+			},
+		}
+	}
+
+	return p.ParseJSON(converted, filename)
+}
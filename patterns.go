@@ -1,6 +1,12 @@
 package main
 
-import "github.com/hashicorp/hcl/v2/hclsimple"
+import (
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/hashicorp/hcl/v2/hclparse"
+)
 
 type Patterns struct {
 	SetName    string    `hcl:"pattern_set_name"`
@@ -8,29 +14,75 @@ type Patterns struct {
 }
 
 type Pattern struct {
-	PatternName string `hcl:"pattern_name,label"`
-	Description string `hcl:"description"`
-	Weight      int    `hcl:"weight"`
-	Target      string `hcl:"target"`
-	Rules       []Rule `hcl:"rule,block"`
+	PatternName string        `hcl:"pattern_name,label"`
+	Description string        `hcl:"description"`
+	Weight      int           `hcl:"weight"`
+	Target      string        `hcl:"target"`
+	Solution    *SolutionRule `hcl:"solution,block"`
+	Rules       []Rule        `hcl:"rule,block"`
+}
+
+// SolutionRule limits a pattern to solutions where the conditions hold for the solution's metadata, conditions can
+// also check solution_name and solution_number
+type SolutionRule struct {
+	Conditions []Condition `hcl:"condition,block"`
 }
 
 type Rule struct {
 	Resource   string      `hcl:"resource"`
 	Conditions []Condition `hcl:"condition,block"`
+	Aggregates []Aggregate `hcl:"aggregate,block"`
+	Links      []LinkRule  `hcl:"link,block"`
 }
 
 type Condition struct {
 	Attribute string `hcl:"attribute"`
 	Operator  string `hcl:"operator"`
-	Value     string `hcl:"value"`
+	Value     string `hcl:"value,optional"`
+}
+
+// Aggregate is a condition which is evaluated over the whole set of resources matched by a rule
+// rather than against each resource in isolation, e.g. sum(cores) lt 32 or count() gte 2
+type Aggregate struct {
+	Function  string `hcl:"function"`
+	Attribute string `hcl:"attribute,optional"`
+	Operator  string `hcl:"operator,optional"`
+	Value     string `hcl:"value,optional"`
+}
+
+// LinkRule matches resources which have a link to another resource, optionally of a given type, where the conditions
+// hold for the attributes of the link
+type LinkRule struct {
+	TargetType string      `hcl:"target_type,optional"`
+	Conditions []Condition `hcl:"condition,block"`
 }
 
 func LoadPatternLibrary(file string) (Patterns, error) {
-	var patterns Patterns
-	err := hclsimple.DecodeFile(file, nil, &patterns)
-	if err != nil {
-		return patterns, err
+	patterns, _, diags := DecodePatternLibrary(hclparse.NewParser(), file)
+	if diags.HasErrors() {
+		return patterns, diags
 	}
 	return patterns, nil
 }
+
+// DecodePatternLibrary parses and decodes a pattern library, in HCL or JSON (.json), and also returns the body so the
+// patterns can be validated against the source
+func DecodePatternLibrary(p *hclparse.Parser, file string) (Patterns, hcl.Body, hcl.Diagnostics) {
+	var patterns Patterns
+	var f *hcl.File
+	var diags hcl.Diagnostics
+	if strings.HasSuffix(file, ".json") {
+		f, diags = p.ParseJSONFile(file)
+	} else {
+		f, diags = p.ParseHCLFile(file)
+	}
+	if diags.HasErrors() {
+		return patterns, nil, diags
+	}
+
+	ctx := &hcl.EvalContext{
+		Functions: standardFunctions(),
+	}
+	diags = append(diags, gohcl.DecodeBody(f.Body, ctx, &patterns)...)
+	return patterns, f.Body, diags
+}
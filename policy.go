@@ -0,0 +1,416 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/jedib0t/go-pretty/v6/table"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Policies is a set of policies, written in the same language as patterns
+type Policies struct {
+	SetName  string   `hcl:"policy_set_name"`
+	Policies []Policy `hcl:"policy,block"`
+}
+
+// Policy is a requirement a solution must meet.  The solution block and the conditions of each rule choose what the
+// policy applies to, and every resource it applies to must meet all the requirements of the rule.  A blocking policy
+// which fails makes the policy command exit with a non-zero status.
+type Policy struct {
+	PolicyName  string        `hcl:"policy_name,label"`
+	Description string        `hcl:"description"`
+	Severity    string        `hcl:"severity,optional"`
+	Blocking    bool          `hcl:"blocking,optional"`
+	Remediation string        `hcl:"remediation,optional"`
+	Solution    *SolutionRule `hcl:"solution,block"`
+	Rules       []PolicyRule  `hcl:"rule,block"`
+}
+
+// PolicyRule applies a policy to the resources of a type which meet the conditions, and lists what they require
+type PolicyRule struct {
+	Resource     string      `hcl:"resource"`
+	Conditions   []Condition `hcl:"condition,block"`
+	Requirements []Condition `hcl:"require,block"`
+}
+
+// PolicyViolation is a resource which does not meet the requirements of a policy
+type PolicyViolation struct {
+	Resource Resource
+	Failures []string
+}
+
+// PolicyResult is the outcome of evaluating a policy against a solution, a policy which does not apply to anything
+// passes
+type PolicyResult struct {
+	Policy     Policy
+	Applies    bool
+	Checked    int
+	Violations []PolicyViolation
+}
+
+// Passed returns true if no resource violated the policy
+func (r PolicyResult) Passed() bool {
+	return len(r.Violations) == 0
+}
+
+// severity returns the severity of the policy's diagnostics, policies are warnings unless they say otherwise
+func (p Policy) severity() hcl.DiagnosticSeverity {
+	if p.Severity == "error" {
+		return hcl.DiagError
+	}
+	return hcl.DiagWarning
+}
+
+// DecodePolicies parses and decodes a policy file, in HCL or JSON (.json), and also returns the body so the policies
+// can be validated against the source
+func DecodePolicies(p *hclparse.Parser, file string) (Policies, hcl.Body, hcl.Diagnostics) {
+	var policies Policies
+	var f *hcl.File
+	var diags hcl.Diagnostics
+	if strings.HasSuffix(file, ".json") {
+		f, diags = p.ParseJSONFile(file)
+	} else {
+		f, diags = p.ParseHCLFile(file)
+	}
+	if diags.HasErrors() {
+		return policies, nil, diags
+	}
+
+	ctx := &hcl.EvalContext{
+		Functions: standardFunctions(),
+	}
+	diags = append(diags, gohcl.DecodeBody(f.Body, ctx, &policies)...)
+	return policies, f.Body, diags
+}
+
+// ValidatePolicies checks the policies make sense for the spec, in the same way as patterns
+func ValidatePolicies(policies Policies, body hcl.Body, typemap map[string]map[string]string) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+	nested := nestedTypes(typemap)
+
+	for i, policy := range policies.Policies {
+		policyBlock := sourceBlock(body, "policy", i, "policy_name")
+		if policy.Severity != "" && policy.Severity != "error" && policy.Severity != "warning" {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid severity",
+				Detail:   fmt.Sprintf("The severity of policy %q must be \"error\" or \"warning\".", policy.PolicyName),
+				Subject:  sourceSubject(policyBlock, "severity"),
+			})
+		}
+
+		if policy.Solution != nil {
+			solutionBlock := sourceBlock(blockBody(policyBlock), "solution", 0)
+			for j, condition := range policy.Solution.Conditions {
+				conditionBlock := sourceBlock(blockBody(solutionBlock), "condition", j)
+				vtype := "string"
+				if condition.Attribute != "solution_name" && condition.Attribute != "solution_number" {
+					vtype = attributeType("metadata", condition.Attribute, typemap)
+				}
+				diags = append(diags, validateCondition(condition, "metadata", vtype, conditionBlock)...)
+			}
+		}
+
+		for j, rule := range policy.Rules {
+			ruleBlock := sourceBlock(blockBody(policyBlock), "rule", j)
+			if _, present := typemap[rule.Resource]; !present || reservedTypes[rule.Resource] || nested[rule.Resource] {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Unknown resource type",
+					Detail:   fmt.Sprintf("The rule in policy %q is for %q, which is not a resource type in the spec.", policy.PolicyName, rule.Resource),
+					Subject:  sourceSubject(ruleBlock, "resource"),
+				})
+				continue
+			}
+			if len(rule.Requirements) == 0 {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagWarning,
+					Summary:  "Rule has no requirements",
+					Detail:   fmt.Sprintf("The rule for %s in policy %q does not require anything, so it always passes.", rule.Resource, policy.PolicyName),
+					Subject:  sourceSubject(ruleBlock, ""),
+				})
+			}
+			for k, condition := range rule.Conditions {
+				conditionBlock := sourceBlock(blockBody(ruleBlock), "condition", k)
+				diags = append(diags, validateCondition(condition, rule.Resource, attributeType(rule.Resource, condition.Attribute, typemap), conditionBlock)...)
+			}
+			for k, requirement := range rule.Requirements {
+				requireBlock := sourceBlock(blockBody(ruleBlock), "require", k)
+				diags = append(diags, validateCondition(requirement, rule.Resource, attributeType(rule.Resource, requirement.Attribute, typemap), requireBlock)...)
+			}
+		}
+	}
+	return diags
+}
+
+// EvaluatePolicies checks every policy against the solution
+func EvaluatePolicies(resources []Resource, solution Solution, policies []Policy, typemap map[string]map[string]string) []PolicyResult {
+	var results []PolicyResult
+	for _, policy := range policies {
+		result := PolicyResult{Policy: policy}
+		if policy.Solution != nil && !CheckSolution(solution, policy.Solution, typemap) {
+			log.WithFields(log.Fields{
+				"policy": policy.PolicyName,
+			}).Debug("Policy does not apply to this solution")
+			results = append(results, result)
+			continue
+		}
+
+		for _, rule := range policy.Rules {
+			for _, resource := range resources {
+				if resource.resourceType != rule.Resource || !checkConditions(resource, rule.Conditions, typemap) {
+					continue
+				}
+				result.Applies = true
+				result.Checked = result.Checked + 1
+
+				var failures []string
+				for _, requirement := range rule.Requirements {
+					if !CheckCondition(resource, requirement, typemap) {
+						failures = append(failures, describeFailure(resource, requirement, typemap))
+					}
+				}
+				if len(failures) > 0 {
+					result.Violations = append(result.Violations, PolicyViolation{Resource: resource, Failures: failures})
+				}
+			}
+		}
+
+		log.WithFields(log.Fields{
+			"policy":     policy.PolicyName,
+			"checked":    result.Checked,
+			"violations": len(result.Violations),
+		}).Debug("Evaluated policy")
+		results = append(results, result)
+	}
+	return results
+}
+
+// checkConditions returns true if all the conditions hold for the resource
+func checkConditions(resource Resource, conditions []Condition, typemap map[string]map[string]string) bool {
+	for _, condition := range conditions {
+		if !CheckCondition(resource, condition, typemap) {
+			return false
+		}
+	}
+	return true
+}
+
+// describeFailure explains why a resource does not meet a requirement
+func describeFailure(resource Resource, requirement Condition, typemap map[string]map[string]string) string {
+	actualValue, _, present := LookupAttribute(resource.resourceAttributes, resource.resourceType, requirement.Attribute, typemap)
+	if !present {
+		return fmt.Sprintf("%s is not set", requirement.Attribute)
+	}
+	return fmt.Sprintf("%s is %v, which is not %s %s", requirement.Attribute, actualValue, requirement.Operator, requirement.Value)
+}
+
+// PolicyDiagnostics turns the violations of the policies into diagnostics, with the remediation in the detail
+func PolicyDiagnostics(results []PolicyResult) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+	for _, result := range results {
+		for _, violation := range result.Violations {
+			detail := fmt.Sprintf("%s does not meet the policy %q: %s.", resourceAddress(violation.Resource), result.Policy.Description, strings.Join(violation.Failures, "; "))
+			if result.Policy.Remediation != "" {
+				detail = detail + " " + result.Policy.Remediation
+			}
+			diag := &hcl.Diagnostic{
+				Severity: result.Policy.severity(),
+				Summary:  "Failed policy " + result.Policy.PolicyName,
+				Detail:   detail,
+			}
+			if violation.Resource.resourceRange.Filename != "" {
+				diag.Subject = violation.Resource.resourceRange.Ptr()
+			}
+			diags = append(diags, diag)
+		}
+	}
+	sortDiagnostics(diags)
+	return diags
+}
+
+// blockingFailures returns the names of the blocking policies which failed
+func blockingFailures(results []PolicyResult) []string {
+	var names []string
+	for _, result := range results {
+		if result.Policy.Blocking && !result.Passed() {
+			names = append(names, result.Policy.PolicyName)
+		}
+	}
+	return names
+}
+
+// policyStatus returns pass, fail or n/a (when the policy does not apply to anything in the solution)
+func policyStatus(result PolicyResult) string {
+	switch {
+	case !result.Passed():
+		return "fail"
+	case !result.Applies:
+		return "n/a"
+	}
+	return "pass"
+}
+
+// PrintTextPolicyTable writes a table with the outcome of each policy
+func PrintTextPolicyTable(w io.Writer, results []PolicyResult) {
+	t := table.NewWriter()
+	t.SetOutputMirror(w)
+	t.AppendHeader(table.Row{"#", "Policy", "Status", "Severity", "Blocking", "Checked", "Violations"})
+	for i, result := range results {
+		severity := result.Policy.Severity
+		if severity == "" {
+			severity = "warning"
+		}
+		t.AppendRow(table.Row{
+			i,
+			result.Policy.PolicyName,
+			policyStatus(result),
+			severity,
+			result.Policy.Blocking,
+			result.Checked,
+			len(result.Violations),
+		})
+	}
+	t.Render()
+}
+
+// jsonPolicyResults is the document written for the json format
+type jsonPolicyResults struct {
+	Passed   bool               `json:"passed"`
+	Policies []jsonPolicyResult `json:"policies"`
+}
+
+type jsonPolicyResult struct {
+	Name        string                `json:"name"`
+	Description string                `json:"description"`
+	Severity    string                `json:"severity"`
+	Blocking    bool                  `json:"blocking"`
+	Remediation string                `json:"remediation,omitempty"`
+	Status      string                `json:"status"`
+	Checked     int                   `json:"checked"`
+	Violations  []jsonPolicyViolation `json:"violations"`
+}
+
+type jsonPolicyViolation struct {
+	Resource string     `json:"resource"`
+	Failures []string   `json:"failures"`
+	Range    *jsonRange `json:"range,omitempty"`
+}
+
+func policyResultsToJSON(results []PolicyResult) jsonPolicyResults {
+	document := jsonPolicyResults{
+		Passed:   len(blockingFailures(results)) == 0,
+		Policies: []jsonPolicyResult{},
+	}
+	for _, result := range results {
+		severity := result.Policy.Severity
+		if severity == "" {
+			severity = "warning"
+		}
+		r := jsonPolicyResult{
+			Name:        result.Policy.PolicyName,
+			Description: result.Policy.Description,
+			Severity:    severity,
+			Blocking:    result.Policy.Blocking,
+			Remediation: result.Policy.Remediation,
+			Status:      policyStatus(result),
+			Checked:     result.Checked,
+			Violations:  []jsonPolicyViolation{},
+		}
+		for _, violation := range result.Violations {
+			v := jsonPolicyViolation{
+				Resource: resourceAddress(violation.Resource),
+				Failures: violation.Failures,
+			}
+			if subject := violation.Resource.resourceRange; subject.Filename != "" {
+				v.Range = &jsonRange{
+					Filename: subject.Filename,
+					Start:    jsonPos{subject.Start.Line, subject.Start.Column, subject.Start.Byte},
+					End:      jsonPos{subject.End.Line, subject.End.Column, subject.End.Byte},
+				}
+			}
+			r.Violations = append(r.Violations, v)
+		}
+		document.Policies = append(document.Policies, r)
+	}
+	return document
+}
+
+// policyCommand evaluates a policy file against a solution, and exits with a non-zero status if a blocking policy
+// fails or the files do not load
+func policyCommand(args []string) {
+	flags := flag.NewFlagSet("design-as-code policy", flag.ExitOnError)
+	var solutionOptions solutionOptions
+	solutionOptions.addFlags(flags)
+	specFile := flags.String("spec", defaultSpecFile, "Path to the spec.")
+	policyFile := flags.String("policies", "policies.hcl", "Path to the file containing the policies.")
+	format := flags.String("format", "text", "How to write the results, 'text', 'json' or 'sarif'.")
+	debugLog := flags.Bool("debug", false, "Should we log verbose messages for debugging?")
+	flags.Parse(args)
+
+	if *debugLog {
+		log.SetLevel(log.DebugLevel)
+	}
+	if !diagnosticFormats[*format] {
+		log.WithFields(log.Fields{
+			"format": *format,
+		}).Fatal("Format is incorrect, expecting 'text', 'json' or 'sarif'")
+	}
+
+	p := hclparse.NewParser()
+	schemas, typemap, specs, diags := readSpec(*specFile)
+	var resources []Resource
+	var app Solution
+	var policies Policies
+	if !diags.HasErrors() {
+		var solutionDiags, policyDiags hcl.Diagnostics
+		resources, app, solutionDiags = decodeSolution(p, solutionOptions, schemas, typemap, specs)
+		var body hcl.Body
+		policies, body, policyDiags = DecodePolicies(p, *policyFile)
+		if !policyDiags.HasErrors() {
+			policyDiags = append(policyDiags, ValidatePolicies(policies, body, typemap)...)
+		}
+		diags = append(append(diags, solutionDiags...), policyDiags...)
+		sortDiagnostics(diags)
+	}
+	if diags.HasErrors() {
+		exitWithDiagnostics(diags, *format, p.Files())
+	}
+
+	log.WithFields(log.Fields{
+		"count": len(policies.Policies),
+		"set":   policies.SetName,
+	}).Info("Evaluating policies")
+	results := EvaluatePolicies(resources, app, policies.Policies, typemap)
+	diags = append(diags, PolicyDiagnostics(results)...)
+
+	var err error
+	switch *format {
+	case "text":
+		PrintTextPolicyTable(os.Stdout, results)
+		fmt.Println()
+		err = WriteDiagnostics(os.Stdout, *format, diags, p.Files())
+	case "json":
+		err = writeJSONDocument(os.Stdout, policyResultsToJSON(results))
+	case "sarif":
+		err = WriteDiagnostics(os.Stdout, *format, diags, p.Files())
+	}
+	if err != nil {
+		log.WithError(err).Fatal("Error writing results")
+	}
+
+	if failed := blockingFailures(results); len(failed) > 0 {
+		log.WithFields(log.Fields{
+			"policies": strings.Join(failed, ", "),
+		}).Error("Blocking policies failed")
+		os.Exit(1)
+	}
+}
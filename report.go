@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"flag"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//go:embed templates/*.tmpl
+var reportTemplates embed.FS
+
+// reportFormats are the formats of the report, with the name of the embedded template for each
+var reportFormats = map[string]string{
+	"markdown": "report.md.tmpl",
+	"html":     "report.html.tmpl",
+}
+
+// maxNearMisses is the number of near misses listed for each unmatched resource
+const maxNearMisses = 3
+
+// ReportData is what the report templates are rendered with, the result document with the resources grouped by type,
+// hints for the unmatched resources and a diagram of the dependencies
+type ReportData struct {
+	Result    MatchResult
+	Inventory []ReportResourceGroup
+	Unmatched []ReportUnmatched
+	Diagram   string
+}
+
+// ReportResourceGroup is the resources of one type
+type ReportResourceGroup struct {
+	Type      string
+	Resources []ResultResource
+}
+
+// ReportUnmatched is a resource no chosen pattern covers, with the patterns which came closest to matching it
+type ReportUnmatched struct {
+	Resource   ResultResource
+	NearMisses []NearMiss
+}
+
+// NearMiss is a pattern with a rule for the type of an unmatched resource, and what stopped the rule matching.  A
+// near miss without any failures matched the resource, but the rest of the pattern did not match or the solver did
+// not choose it.
+type NearMiss struct {
+	Pattern  string
+	Target   string
+	Failures []string
+}
+
+// BuildReportData builds the data for a report from a solution which has been matched
+func BuildReportData(report solutionReport, app Solution, patterns Patterns, typemap map[string]map[string]string) ReportData {
+	data := ReportData{
+		Result:  report.result,
+		Diagram: MermaidGraph(report.result, GraphOptions{GroupBy: "color"}),
+	}
+
+	byType := make(map[string][]ResultResource)
+	var types []string
+	for _, resource := range report.result.Resources {
+		if _, seen := byType[resource.Type]; !seen {
+			types = append(types, resource.Type)
+		}
+		byType[resource.Type] = append(byType[resource.Type], resource)
+	}
+	sort.Strings(types)
+	for _, resourceType := range types {
+		data.Inventory = append(data.Inventory, ReportResourceGroup{Type: resourceType, Resources: byType[resourceType]})
+	}
+
+	byAddress := make(map[string]Resource)
+	for _, resource := range report.resources {
+		byAddress[resourceAddress(resource)] = resource
+	}
+	results := make(map[string]ResultResource)
+	for _, resource := range report.result.Resources {
+		results[resource.Address] = resource
+	}
+	for _, address := range report.result.Unmatched {
+		data.Unmatched = append(data.Unmatched, ReportUnmatched{
+			Resource:   results[address],
+			NearMisses: nearMisses(byAddress[address], app, patterns.PatternSet, typemap),
+		})
+	}
+	return data
+}
+
+// nearMisses finds the patterns which came closest to matching a resource, those with the fewest failed conditions
+// in a rule for its type.  Patterns which do not apply to the solution are left out.
+func nearMisses(resource Resource, app Solution, patterns []Pattern, typemap map[string]map[string]string) []NearMiss {
+	var misses []NearMiss
+	for _, pattern := range patterns {
+		if pattern.Solution != nil && !CheckSolution(app, pattern.Solution, typemap) {
+			continue
+		}
+		var closest *NearMiss
+		for _, rule := range pattern.Rules {
+			if rule.Resource != resource.resourceType {
+				continue
+			}
+			miss := NearMiss{Pattern: pattern.PatternName, Target: pattern.Target, Failures: []string{}}
+			for _, condition := range rule.Conditions {
+				if !CheckCondition(resource, condition, typemap) {
+					miss.Failures = append(miss.Failures, describeFailure(resource, condition, typemap))
+				}
+			}
+			for _, linkRule := range rule.Links {
+				if !CheckLinks(resource, linkRule, typemap) {
+					miss.Failures = append(miss.Failures, describeLinkFailure(linkRule))
+				}
+			}
+			if closest == nil || len(miss.Failures) < len(closest.Failures) {
+				closest = &miss
+			}
+		}
+		if closest != nil {
+			misses = append(misses, *closest)
+		}
+	}
+	sort.SliceStable(misses, func(i, j int) bool {
+		return len(misses[i].Failures) < len(misses[j].Failures)
+	})
+	if len(misses) > maxNearMisses {
+		misses = misses[:maxNearMisses]
+	}
+	return misses
+}
+
+// describeLinkFailure explains why a resource does not meet a link rule
+func describeLinkFailure(linkRule LinkRule) string {
+	target := "anything"
+	if linkRule.TargetType != "" {
+		target = "a " + linkRule.TargetType
+	}
+	if len(linkRule.Conditions) > 0 {
+		return fmt.Sprintf("there is no link to %s which meets the link conditions", target)
+	}
+	return fmt.Sprintf("there is no link to %s", target)
+}
+
+// formatValue formats an attribute value for a report, the attributes of a block are listed in braces
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case []ResultAttribute:
+		var parts []string
+		for _, attribute := range v {
+			parts = append(parts, attribute.Name+" = "+formatValue(attribute.Value))
+		}
+		return "{ " + strings.Join(parts, ", ") + " }"
+	case []string:
+		return "[" + strings.Join(v, ", ") + "]"
+	case map[string]string:
+		var parts []string
+		for _, key := range sortedKeys(v) {
+			parts = append(parts, key+"="+v[key])
+		}
+		return strings.Join(parts, ", ")
+	case nil:
+		return ""
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// markdownCell escapes a value so it can go in a Markdown table
+func markdownCell(value interface{}) string {
+	s, ok := value.(string)
+	if !ok {
+		s = formatValue(value)
+	}
+	s = strings.ReplaceAll(s, "|", "\\|")
+	return strings.ReplaceAll(s, "\n", " ")
+}
+
+// reportFunctions are the functions the report templates can use, the helpers for user templates and some for
+// formatting values
+func reportFunctions() map[string]interface{} {
+	functions := map[string]interface{}(templateFunctions())
+	functions["value"] = formatValue
+	functions["cell"] = markdownCell
+	functions["percent"] = func(f float64) string { return fmt.Sprintf("%.0f%%", f*100) }
+	functions["pattern"] = func(p *string) string {
+		if p == nil {
+			return ""
+		}
+		return *p
+	}
+	return functions
+}
+
+// reportTemplate is a template for one of the report formats, either a text or an HTML template
+type reportTemplate interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+// loadReportTemplate loads the embedded template for a format, then any templates with the same extension in the
+// template directory, so a directory can replace the whole report or just redefine some of the templates in it
+func loadReportTemplate(format string, templateDir string) (reportTemplate, error) {
+	name := reportFormats[format]
+	var overrides []string
+	if templateDir != "" {
+		var err error
+		overrides, err = filepath.Glob(filepath.Join(templateDir, "*"+strings.TrimPrefix(name, "report")))
+		if err != nil {
+			return nil, err
+		}
+		if len(overrides) == 0 {
+			log.WithFields(log.Fields{
+				"directory": templateDir,
+				"format":    format,
+			}).Warn("No templates for this format in the template directory")
+		}
+	}
+
+	if format == "html" {
+		t, err := htmltemplate.New(name).Funcs(reportFunctions()).ParseFS(reportTemplates, "templates/"+name)
+		if err != nil {
+			return nil, err
+		}
+		if len(overrides) > 0 {
+			if t, err = t.ParseFiles(overrides...); err != nil {
+				return nil, err
+			}
+		}
+		return t, nil
+	}
+
+	t, err := template.New(name).Funcs(reportFunctions()).ParseFS(reportTemplates, "templates/"+name)
+	if err != nil {
+		return nil, err
+	}
+	if len(overrides) > 0 {
+		if t, err = t.ParseFiles(overrides...); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// reportCommand matches a solution against the pattern library and writes a report of the result, for reviewing the
+// design of an application
+func reportCommand(args []string) {
+	flags := flag.NewFlagSet("design-as-code report", flag.ExitOnError)
+	var solutionOptions solutionOptions
+	solutionOptions.addFlags(flags)
+	options := reportOptions{toolMode: "match", outputFormat: "table"}
+	flags.StringVar(&options.patternsLibraryFile, "patternlib", "patterns.hcl", "Path to the file containing the list of patterns to use for matching.")
+	flags.StringVar(&options.solveMode, "solvefor", "priority", "What solution mode should we use.")
+	flags.BoolVar(&options.quiet, "quiet", false, "Only log errors.")
+	flags.BoolVar(&options.debugLog, "debug", false, "Should we log verbose messages for debugging?")
+	format := flags.String("format", "markdown", "The format of the report, 'markdown' or 'html'.")
+	outFile := flags.String("o", "", "Write the report to this file. (default stdout)")
+	templateDir := flags.String("templates", "", "A directory of templates which replace the built in report templates, or some of the templates in them.")
+	flags.Parse(args)
+
+	options.setLogLevel()
+	if _, ok := reportFormats[*format]; !ok {
+		log.WithFields(log.Fields{
+			"format": *format,
+		}).Fatal("Format is incorrect, expecting 'markdown' or 'html'")
+	}
+
+	t, err := loadReportTemplate(*format, *templateDir)
+	if err != nil {
+		log.WithError(err).Fatal("Cannot load the report template")
+	}
+
+	schemas, typemap, specs, hash := loadSchema()
+	options.specHash = hash
+	patterns := loadPatterns(options.patternsLibraryFile)
+	resources, app := loadSolution(solutionOptions, schemas, typemap, specs)
+	report := reportSolution(resources, app, patterns, typemap, options)
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, BuildReportData(report, app, patterns, typemap)); err != nil {
+		log.WithError(err).Fatal("Error rendering the report")
+	}
+	if *outFile == "" {
+		os.Stdout.Write(buf.Bytes())
+		return
+	}
+	if err := ioutil.WriteFile(*outFile, buf.Bytes(), 0644); err != nil {
+		log.WithError(err).Fatal("Error writing the report")
+	}
+	log.WithFields(log.Fields{
+		"file": *outFile,
+	}).Info("Report written")
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"runtime/debug"
+	"sort"
+	"time"
+)
+
+// resultSchemaVersion is the version of the result document, see result-schema.json.  It goes up whenever a change
+// could break a reader, adding fields does not change it.
+const resultSchemaVersion = 1
+
+// toolVersion is the version of the tool, set when building a release with -ldflags "-X main.toolVersion=1.2.3"
+var toolVersion = "dev"
+
+// MatchResult is the result of matching a solution against a pattern library
+type MatchResult struct {
+	SchemaVersion int              `json:"schema_version"`
+	Run           ResultRun        `json:"run"`
+	Solution      ResultSolution   `json:"solution"`
+	Resources     []ResultResource `json:"resources"`
+	Patterns      []ResultPattern  `json:"patterns"`
+	Unmatched     []string         `json:"unmatched"`
+	Solver        ResultSolver     `json:"solver"`
+}
+
+// ResultRun describes the run which produced a result
+type ResultRun struct {
+	ToolVersion string `json:"tool_version"`
+	GeneratedAt string `json:"generated_at"`
+	PatternSet  string `json:"pattern_set"`
+	PatternFile string `json:"pattern_file"`
+	SpecHash    string `json:"spec_hash"`
+}
+
+// ResultSolution is the solution's name, number and metadata
+type ResultSolution struct {
+	Name     string            `json:"name"`
+	Number   string            `json:"number,omitempty"`
+	Metadata []ResultAttribute `json:"metadata"`
+}
+
+// ResultResource is a resource with its attributes, and the pattern the solver chose for it, if any
+type ResultResource struct {
+	Address     string            `json:"address"`
+	Type        string            `json:"type"`
+	Name        string            `json:"name"`
+	Module      string            `json:"module,omitempty"`
+	Description string            `json:"description,omitempty"`
+	Tags        map[string]string `json:"tags"`
+	DependsOn   []string          `json:"depends_on"`
+	Links       []ResultLink      `json:"links"`
+	Attributes  []ResultAttribute `json:"attributes"`
+	Pattern     *string           `json:"pattern"`
+}
+
+// ResultLink is a link from a resource to another
+type ResultLink struct {
+	Target     string            `json:"target"`
+	TargetType string            `json:"target_type"`
+	Attributes []ResultAttribute `json:"attributes"`
+}
+
+// ResultAttribute is an attribute with its type from the spec, the value keeps its type in JSON, and the value of a
+// nested block is a list of its attributes
+type ResultAttribute struct {
+	Name  string      `json:"name"`
+	Type  string      `json:"type"`
+	Value interface{} `json:"value"`
+}
+
+// ResultPattern is a pattern the solver chose, with the resources it covers
+type ResultPattern struct {
+	Name           string   `json:"name"`
+	Description    string   `json:"description"`
+	Target         string   `json:"target"`
+	Weight         int      `json:"weight"`
+	ConditionCount int      `json:"condition_count"`
+	Resources      []string `json:"resources"`
+}
+
+// ResultSolver is the solver which chose the patterns, and how well the chosen patterns do
+type ResultSolver struct {
+	Name      string          `json:"name"`
+	Objective ResultObjective `json:"objective"`
+}
+
+// ResultObjective are the scores of the chosen patterns, the priority solver prefers a low total weight and the max
+// solver prefers a high coverage
+type ResultObjective struct {
+	Coverage           float64 `json:"coverage"`
+	MatchedResources   int     `json:"matched_resources"`
+	UnmatchedResources int     `json:"unmatched_resources"`
+	SelectedPatterns   int     `json:"selected_patterns"`
+	TotalWeight        int     `json:"total_weight"`
+	ConditionCount     int     `json:"condition_count"`
+}
+
+// version returns the version of the tool, from the build if it was not set when building
+func version() string {
+	if toolVersion != "dev" {
+		return toolVersion
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return toolVersion
+}
+
+// specHash returns the SHA-256 of a spec
+func specHash(src []byte) string {
+	sum := sha256.Sum256(src)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// BuildMatchResult builds the result document from the patterns the solver chose, the resources and patterns are in
+// address and selection order so the document is the same for the same inputs, apart from when it was generated
+func BuildMatchResult(resources []Resource, app Solution, patterns Patterns, solution []MatchedPattern, unmatched []string, typemap map[string]map[string]string, options reportOptions) MatchResult {
+	result := MatchResult{
+		SchemaVersion: resultSchemaVersion,
+		Run: ResultRun{
+			ToolVersion: version(),
+			GeneratedAt: time.Now().UTC().Format(time.RFC3339),
+			PatternSet:  patterns.SetName,
+			PatternFile: options.patternsLibraryFile,
+			SpecHash:    options.specHash,
+		},
+		Solution: ResultSolution{
+			Name:     app.solutionName,
+			Number:   app.solutionNumber,
+			Metadata: typedAttributes(app.solutionMetadata, "metadata", typemap),
+		},
+		Resources: []ResultResource{},
+		Patterns:  []ResultPattern{},
+		Unmatched: []string{},
+		Solver:    ResultSolver{Name: options.solveMode},
+	}
+
+	assigned := make(map[string]string)
+	for _, match := range solution {
+		pattern := ResultPattern{
+			Name:           match.Pattern.PatternName,
+			Description:    match.Pattern.Description,
+			Target:         match.Pattern.Target,
+			Weight:         match.Pattern.Weight,
+			ConditionCount: match.ConditionCount,
+			Resources:      []string{},
+		}
+		for _, resource := range match.Resources {
+			pattern.Resources = append(pattern.Resources, resourceAddress(resource))
+			assigned[resourceKey(resource)] = match.Pattern.PatternName
+		}
+		result.Patterns = append(result.Patterns, pattern)
+		result.Solver.Objective.TotalWeight += match.Pattern.Weight
+		result.Solver.Objective.ConditionCount += match.ConditionCount
+	}
+
+	unmatchedKeys := make(map[string]bool)
+	for _, key := range unmatched {
+		unmatchedKeys[key] = true
+	}
+
+	sorted := append([]Resource{}, resources...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return resourceAddress(sorted[i]) < resourceAddress(sorted[j])
+	})
+	for _, resource := range sorted {
+		r := ResultResource{
+			Address:    resourceAddress(resource),
+			Type:       resource.resourceType,
+			Name:       resource.resourceName,
+			Module:     resource.resourceModule,
+			Tags:       map[string]string{},
+			DependsOn:  []string{},
+			Links:      []ResultLink{},
+			Attributes: typedAttributes(resource.resourceAttributes, resource.resourceType, typemap, "depends_on", "description", "tags"),
+		}
+		if description, ok := resource.resourceAttributes["description"].(string); ok {
+			r.Description = description
+		}
+		if tags, ok := resource.resourceAttributes["tags"].(map[string]string); ok {
+			r.Tags = tags
+		}
+		r.DependsOn = append(r.DependsOn, resourceDependencies(resource)...)
+		sort.Strings(r.DependsOn)
+		for _, link := range resource.resourceLinks {
+			r.Links = append(r.Links, ResultLink{
+				Target:     link.target,
+				TargetType: link.targetType,
+				Attributes: typedAttributes(link.relationshipAttributes, "link", typemap),
+			})
+		}
+		sort.SliceStable(r.Links, func(i, j int) bool {
+			return r.Links[i].Target < r.Links[j].Target
+		})
+		if pattern, present := assigned[resourceKey(resource)]; present {
+			r.Pattern = &pattern
+			result.Solver.Objective.MatchedResources++
+		}
+		if unmatchedKeys[resourceKey(resource)] {
+			result.Unmatched = append(result.Unmatched, r.Address)
+		}
+		result.Resources = append(result.Resources, r)
+	}
+
+	result.Solver.Objective.UnmatchedResources = len(result.Unmatched)
+	result.Solver.Objective.SelectedPatterns = len(result.Patterns)
+	if len(resources) > 0 {
+		result.Solver.Objective.Coverage = float64(result.Solver.Objective.MatchedResources) / float64(len(resources))
+	}
+	return result
+}
+
+// typedAttributes converts decoded attributes to a list sorted by name, with the type of each one from the spec,
+// leaving out any attributes which have their own fields
+func typedAttributes(attributes map[string]interface{}, blockType string, typemap map[string]map[string]string, skip ...string) []ResultAttribute {
+	var names []string
+	for name := range attributes {
+		if !containsString(skip, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	out := []ResultAttribute{}
+	for _, name := range names {
+		attribute := ResultAttribute{
+			Name:  name,
+			Type:  typemap[blockType][name],
+			Value: attributes[name],
+		}
+		if nested, ok := attributes[name].(map[string]interface{}); ok && attribute.Type == "block" {
+			attribute.Value = typedAttributes(nested, name, typemap)
+		}
+		out = append(out, attribute)
+	}
+	return out
+}
@@ -2,25 +2,240 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"regexp"
 
 	"github.com/hashicorp/hcl/v2"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v3"
 )
 
-func ReadSchema(schemas map[string]hcl.BodySchema, typemap map[string]map[string]string) error {
-	log.Debug("Reading solution-spec.yml")
-	schema, err := ioutil.ReadFile("solution-spec.yml")
+// AttributeSpec holds everything the spec says about a single attribute of a block
+type AttributeSpec struct {
+	Type     string
+	Values   []string
+	Required bool
+	Default  interface{}
+	Min      *float64
+	Max      *float64
+	Pattern  *regexp.Regexp
+}
+
+// reservedTypes are top level entries in the spec which are not resource types, link sets the attributes of links
+// between resources and metadata sets the attributes of the solution's metadata block
+var reservedTypes = map[string]bool{
+	"link":     true,
+	"metadata": true,
+}
+
+// supportedTypes are the attribute types which can be used in the spec
+var supportedTypes = map[string]bool{
+	"string":       true,
+	"bool":         true,
+	"int":          true,
+	"float":        true,
+	"list(string)": true,
+	"list(int)":    true,
+	"map(string)":  true,
+	"enum":         true,
+	"block":        true,
+}
+
+// parseAttributeSpec reads the spec for an attribute, which is either just the name of the type or a map with a type
+// and (for enums) the allowed values
+func parseAttributeSpec(name string, in interface{}) (AttributeSpec, error) {
+	var spec AttributeSpec
+	switch v := in.(type) {
+	case string:
+		spec.Type = v
+	case map[string]interface{}:
+		vtype, ok := v["type"].(string)
+		if !ok {
+			return spec, fmt.Errorf("attribute '%s' does not have a type", name)
+		}
+		spec.Type = vtype
+		for key := range v {
+			switch key {
+			case "type", "values", "required", "default", "min", "max", "pattern":
+			default:
+				return spec, fmt.Errorf("attribute '%s' has unknown setting '%s'", name, key)
+			}
+		}
+		if values, present := v["values"]; present {
+			list, ok := values.([]interface{})
+			if !ok {
+				return spec, fmt.Errorf("values for attribute '%s' should be a list", name)
+			}
+			for _, value := range list {
+				spec.Values = append(spec.Values, fmt.Sprint(value))
+			}
+		}
+		if required, present := v["required"]; present {
+			spec.Required, ok = required.(bool)
+			if !ok {
+				return spec, fmt.Errorf("required for attribute '%s' should be true or false", name)
+			}
+		}
+		for _, bound := range []string{"min", "max"} {
+			value, present := v[bound]
+			if !present {
+				continue
+			}
+			number, ok := specNumber(value)
+			if !ok {
+				return spec, fmt.Errorf("%s for attribute '%s' should be a number", bound, name)
+			}
+			if bound == "min" {
+				spec.Min = &number
+			} else {
+				spec.Max = &number
+			}
+		}
+		if pattern, present := v["pattern"]; present {
+			expr, ok := pattern.(string)
+			if !ok {
+				return spec, fmt.Errorf("pattern for attribute '%s' should be a string", name)
+			}
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return spec, fmt.Errorf("pattern for attribute '%s' is not a valid regular expression: %v", name, err)
+			}
+			spec.Pattern = re
+		}
+		spec.Default = v["default"]
+	default:
+		return spec, fmt.Errorf("cannot understand the spec for attribute '%s'", name)
+	}
+
+	// number is an alias for float
+	if spec.Type == "number" {
+		spec.Type = "float"
+	}
+	if !supportedTypes[spec.Type] {
+		return spec, fmt.Errorf("attribute '%s' has unknown type '%s'", name, spec.Type)
+	}
+	if spec.Type == "enum" && len(spec.Values) == 0 {
+		return spec, fmt.Errorf("enum attribute '%s' needs a list of allowed values", name)
+	}
+	if spec.Type != "enum" && len(spec.Values) > 0 {
+		return spec, fmt.Errorf("attribute '%s' has values, but only enums can have values", name)
+	}
+	if (spec.Min != nil || spec.Max != nil) && spec.Type != "int" && spec.Type != "float" {
+		return spec, fmt.Errorf("attribute '%s' has min or max, but only ints and floats can have these", name)
+	}
+	if spec.Pattern != nil && spec.Type != "string" {
+		return spec, fmt.Errorf("attribute '%s' has a pattern, but only strings can have a pattern", name)
+	}
+	if spec.Default != nil {
+		if spec.Required {
+			return spec, fmt.Errorf("attribute '%s' is required, so it cannot have a default", name)
+		}
+		value, err := convertDefault(spec, spec.Default)
+		if err != nil {
+			return spec, fmt.Errorf("default for attribute '%s' is not valid: %v", name, err)
+		}
+		spec.Default = value
+	}
+	return spec, nil
+}
+
+// specNumber converts numbers read from the YAML spec into a float64
+func specNumber(in interface{}) (float64, bool) {
+	switch v := in.(type) {
+	case int:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// convertDefault converts a default value read from the YAML spec into the same go type the decoder produces for the
+// attribute, so defaults look exactly like values set in the solution file
+func convertDefault(spec AttributeSpec, in interface{}) (interface{}, error) {
+	switch spec.Type {
+	case "string", "enum":
+		if v, ok := in.(string); ok {
+			return v, nil
+		}
+	case "bool":
+		if v, ok := in.(bool); ok {
+			return v, nil
+		}
+	case "int":
+		if v, ok := in.(int); ok {
+			return v, nil
+		}
+	case "float":
+		if v, ok := specNumber(in); ok {
+			return v, nil
+		}
+	case "list(string)":
+		if list, ok := in.([]interface{}); ok {
+			out := []string{}
+			for _, item := range list {
+				v, ok := item.(string)
+				if !ok {
+					return nil, errors.New("expecting a list of strings")
+				}
+				out = append(out, v)
+			}
+			return out, nil
+		}
+	case "list(int)":
+		if list, ok := in.([]interface{}); ok {
+			out := []int{}
+			for _, item := range list {
+				v, ok := item.(int)
+				if !ok {
+					return nil, errors.New("expecting a list of ints")
+				}
+				out = append(out, v)
+			}
+			return out, nil
+		}
+	case "map(string)":
+		if m, ok := in.(map[string]interface{}); ok {
+			out := make(map[string]string)
+			for key, item := range m {
+				v, ok := item.(string)
+				if !ok {
+					return nil, errors.New("expecting a map of strings")
+				}
+				out[key] = v
+			}
+			return out, nil
+		}
+	case "block":
+		return nil, errors.New("blocks cannot have defaults")
+	}
+	return nil, fmt.Errorf("expecting a value of type %s", spec.Type)
+}
+
+// defaultSpecFile is the spec which is used unless another is given
+const defaultSpecFile = "solution-spec.yml"
+
+// ReadSchema reads the spec file and fills in the HCL schema, attribute types and attribute specs for every block type.
+// The spec is returned as it was read, so the result document can record which spec was used.
+func ReadSchema(file string, schemas map[string]hcl.BodySchema, typemap map[string]map[string]string, specs map[string]map[string]AttributeSpec) ([]byte, error) {
+	log.WithFields(log.Fields{
+		"file": file,
+	}).Debug("Reading spec")
+	schema, err := ioutil.ReadFile(file)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	return schema, parseSchema(schema, schemas, typemap, specs)
+}
 
+// parseSchema parses a spec and fills in the HCL schema, attribute types and attribute specs for every block type
+func parseSchema(schema []byte, schemas map[string]hcl.BodySchema, typemap map[string]map[string]string, specs map[string]map[string]AttributeSpec) error {
 	log.Debug("Parsing schema...")
 	data := make(map[interface{}]interface{})
-	err = yaml.Unmarshal(schema, &data)
+	err := yaml.Unmarshal(schema, &data)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	log.Debug("Creating HCL schema typemap and map of schemas")
@@ -28,20 +243,46 @@ func ReadSchema(schemas map[string]hcl.BodySchema, typemap map[string]map[string
 		log.WithFields(log.Fields{
 			"resource": k,
 		}).Debug("Got resource block from spec")
+		if _, ok := k.(string); !ok {
+			return fmt.Errorf("'%v' is not a valid block type, block types must be strings", k)
+		}
+		blockAttributes, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("block '%s' must be a map of attribute names to types", k)
+		}
 		typemap[k.(string)] = make(map[string]string)
+		specs[k.(string)] = make(map[string]AttributeSpec)
 		attributes := []hcl.AttributeSchema{}
 		blocks := []hcl.BlockHeaderSchema{}
-		for vname, vtype := range v.(map[string]interface{}) {
+		for vname, vtype := range blockAttributes {
 			log.WithFields(log.Fields{
 				"resource":     k,
 				"variableName": vname,
 				"variableType": vtype,
 			}).Debug("Got variable in resource")
+			// depends_on is added automatically, but the spec can list the resource types this type may depend on
 			if vname == "depends_on" {
-				return errors.New("do not specify 'depends_on' as an attribute to a block")
+				allowed, ok := vtype.([]interface{})
+				if !ok {
+					return errors.New("do not specify 'depends_on' as an attribute to a block, it can only be given a list of the resource types this block may depend on")
+				}
+				spec := AttributeSpec{Type: "depends_on", Values: []string{}}
+				for _, target := range allowed {
+					spec.Values = append(spec.Values, fmt.Sprint(target))
+				}
+				specs[k.(string)][vname] = spec
+				continue
+			}
+			if vname == "link" {
+				return errors.New("do not specify 'link' as an attribute to a block, the attributes of links are set by the top level 'link' entry in the spec")
+			}
+			spec, err := parseAttributeSpec(k.(string)+"."+vname, vtype)
+			if err != nil {
+				return err
 			}
-			typemap[k.(string)][vname] = vtype.(string)
-			if vtype.(string) == "block" {
+			typemap[k.(string)][vname] = spec.Type
+			specs[k.(string)][vname] = spec
+			if spec.Type == "block" {
 				block := hcl.BlockHeaderSchema{
 					Type: vname,
 				}
@@ -49,7 +290,7 @@ func ReadSchema(schemas map[string]hcl.BodySchema, typemap map[string]map[string
 			} else {
 				attribute := hcl.AttributeSchema{
 					Name:     vname,
-					Required: false,
+					Required: spec.Required,
 				}
 				attributes = append(attributes, attribute)
 			}
@@ -67,10 +308,131 @@ func ReadSchema(schemas map[string]hcl.BodySchema, typemap map[string]map[string
 		schemas[k.(string)] = schema
 	}
 
+	// nested blocks need to have their own entry in the spec
+	for blockType, attributes := range typemap {
+		for name, vtype := range attributes {
+			if _, present := typemap[name]; vtype == "block" && !present {
+				return fmt.Errorf("block '%s' used in '%s' is not defined in the spec", name, blockType)
+			}
+		}
+	}
+
+	// the metadata block belongs to the solution, so it does not have dependencies
+	if metadataSchema, present := schemas["metadata"]; present {
+		if len(metadataSchema.Blocks) > 0 {
+			return errors.New("metadata cannot contain nested blocks")
+		}
+		attributes := []hcl.AttributeSchema{}
+		for _, attribute := range metadataSchema.Attributes {
+			if attribute.Name != "depends_on" {
+				attributes = append(attributes, attribute)
+			}
+		}
+		metadataSchema.Attributes = attributes
+		schemas["metadata"] = metadataSchema
+	}
+
+	// every resource type can have tags and a description
+	if err := addTagsAndDescription(schemas, typemap, specs); err != nil {
+		return err
+	}
+
+	// if links are defined then every resource type can have link blocks, links always have a target
+	if _, present := schemas["link"]; present {
+		if err := addLinks(schemas, typemap); err != nil {
+			return err
+		}
+	}
+
+	// as do the types listed in depends_on
+	for blockType, attributes := range specs {
+		for _, target := range attributes["depends_on"].Values {
+			if _, present := typemap[target]; !present {
+				return fmt.Errorf("type '%s' listed in depends_on for '%s' is not defined in the spec", target, blockType)
+			}
+		}
+	}
+
 	return nil
 
 }
 
+// nestedTypes returns the types which are used as nested blocks in other types
+func nestedTypes(typemap map[string]map[string]string) map[string]bool {
+	nested := make(map[string]bool)
+	for _, attributes := range typemap {
+		for name, vtype := range attributes {
+			if vtype == "block" {
+				nested[name] = true
+			}
+		}
+	}
+	return nested
+}
+
+// addTagsAndDescription adds the tags and description attributes to every resource type, in the same way as
+// depends_on, so resources can be annotated without changing the spec
+func addTagsAndDescription(schemas map[string]hcl.BodySchema, typemap map[string]map[string]string, specs map[string]map[string]AttributeSpec) error {
+	nested := nestedTypes(typemap)
+	added := map[string]string{
+		"tags":        "map(string)",
+		"description": "string",
+	}
+	for blockType, schema := range schemas {
+		if reservedTypes[blockType] || nested[blockType] {
+			continue
+		}
+		for name, vtype := range added {
+			if _, present := typemap[blockType][name]; present {
+				return fmt.Errorf("do not specify '%s' as an attribute to '%s', it is added automatically", name, blockType)
+			}
+			typemap[blockType][name] = vtype
+			specs[blockType][name] = AttributeSpec{Type: vtype}
+			schema.Attributes = append(schema.Attributes, hcl.AttributeSchema{
+				Name:     name,
+				Required: false,
+			})
+		}
+		schemas[blockType] = schema
+	}
+	return nil
+}
+
+// addLinks sets up the schema for link blocks and adds them to each of the resource types
+func addLinks(schemas map[string]hcl.BodySchema, typemap map[string]map[string]string) error {
+	linkSchema := schemas["link"]
+	if len(linkSchema.Blocks) > 0 {
+		return errors.New("links cannot contain nested blocks")
+	}
+	if _, present := typemap["link"]["target"]; present {
+		return errors.New("do not specify 'target' as an attribute of a link, it is added automatically")
+	}
+
+	// the target is decoded by DecodeLinks
+	attributes := []hcl.AttributeSchema{}
+	for _, attribute := range linkSchema.Attributes {
+		if attribute.Name != "depends_on" {
+			attributes = append(attributes, attribute)
+		}
+	}
+	linkSchema.Attributes = attributes
+	schemas["link"] = linkSchema
+
+	// nested blocks are part of a resource, so they don't get links of their own
+	nested := nestedTypes(typemap)
+	for blockType, schema := range schemas {
+		if reservedTypes[blockType] || nested[blockType] {
+			continue
+		}
+		schema.Blocks = append(schema.Blocks, hcl.BlockHeaderSchema{
+			Type: "link",
+		})
+		schemas[blockType] = schema
+	}
+
+	return nil
+}
+
 var solutionSchema = &hcl.BodySchema{
 	Attributes: []hcl.AttributeSchema{
 		{
@@ -87,5 +449,19 @@ var solutionSchema = &hcl.BodySchema{
 			Type:       "resource",
 			LabelNames: []string{"type", "name"},
 		},
+		{
+			Type:       "variable",
+			LabelNames: []string{"name"},
+		},
+		{
+			Type: "locals",
+		},
+		{
+			Type:       "module",
+			LabelNames: []string{"name"},
+		},
+		{
+			Type: "metadata",
+		},
 	},
 }
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// templateFunctions are the helpers for user templates and the report templates.  The list comes last so they can
+// be used in pipelines, e.g. {{ .Resources | sortBy "type" }}.
+func templateFunctions() template.FuncMap {
+	return template.FuncMap{
+		"join":    templateJoin,
+		"toJSON":  templateToJSON,
+		"sortBy":  templateSortBy,
+		"groupBy": templateGroupBy,
+		"attr":    templateAttr,
+	}
+}
+
+// TemplateGroup is a group made by groupBy, the items which have the same value for the field
+type TemplateGroup struct {
+	Key   string
+	Items []interface{}
+}
+
+// LoadTemplate reads a user template from a file
+func LoadTemplate(file string) (*template.Template, error) {
+	return template.New(filepath.Base(file)).Funcs(templateFunctions()).ParseFiles(file)
+}
+
+// RenderTemplate renders a user template with the result document of each report
+func RenderTemplate(w io.Writer, t *template.Template, reports []solutionReport) error {
+	for _, report := range reports {
+		if err := t.Execute(w, report.result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeTemplateOutput renders the template to a file, or to stdout if the file is empty.  Nothing is written to the
+// file if the template fails.
+func writeTemplateOutput(file string, t *template.Template, reports []solutionReport) error {
+	if file == "" {
+		return RenderTemplate(os.Stdout, t, reports)
+	}
+	var buf bytes.Buffer
+	if err := RenderTemplate(&buf, t, reports); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, buf.Bytes(), 0644)
+}
+
+// templateList turns a slice or array into a list of its items
+func templateList(list interface{}) ([]interface{}, error) {
+	v := reflect.ValueOf(list)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return nil, fmt.Errorf("expecting a list, not %T", list)
+	}
+	items := make([]interface{}, v.Len())
+	for i := range items {
+		items[i] = v.Index(i).Interface()
+	}
+	return items, nil
+}
+
+// templateField returns the value of a field of a struct, by its name or its JSON name, or of a key in a map
+func templateField(item interface{}, field string) (interface{}, error) {
+	v := reflect.ValueOf(item)
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil, nil
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			jsonName := strings.Split(f.Tag.Get("json"), ",")[0]
+			if f.PkgPath == "" && (f.Name == field || jsonName == field) {
+				return v.Field(i).Interface(), nil
+			}
+		}
+		return nil, fmt.Errorf("%s does not have a field called %s", v.Type().Name(), field)
+	case reflect.Map:
+		value := v.MapIndex(reflect.ValueOf(field))
+		if !value.IsValid() {
+			return nil, nil
+		}
+		return value.Interface(), nil
+	}
+	return nil, fmt.Errorf("cannot get %s from %T", field, item)
+}
+
+// templateString formats a value for joining, sorting and grouping, pointers are followed and nil is empty
+func templateString(value interface{}) string {
+	v := reflect.ValueOf(value)
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		return ""
+	}
+	return fmt.Sprintf("%v", v.Interface())
+}
+
+// templateJoin joins the items of a list with a separator, e.g. {{ join .DependsOn ", " }}
+func templateJoin(list interface{}, sep string) (string, error) {
+	items, err := templateList(list)
+	if err != nil {
+		return "", err
+	}
+	parts := make([]string, len(items))
+	for i, item := range items {
+		parts[i] = templateString(item)
+	}
+	return strings.Join(parts, sep), nil
+}
+
+// templateToJSON writes a value as JSON
+func templateToJSON(value interface{}) (string, error) {
+	src, err := json.Marshal(value)
+	return string(src), err
+}
+
+// templateSortBy sorts a list by a field, numbers are sorted by value and anything else as text
+func templateSortBy(field string, list interface{}) ([]interface{}, error) {
+	items, err := templateList(list)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]interface{}, len(items))
+	for i, item := range items {
+		if keys[i], err = templateField(item, field); err != nil {
+			return nil, err
+		}
+	}
+	index := make([]int, len(items))
+	for i := range index {
+		index[i] = i
+	}
+	sort.SliceStable(index, func(i, j int) bool {
+		a, aNumber := toFloat(keys[index[i]])
+		b, bNumber := toFloat(keys[index[j]])
+		if aNumber && bNumber {
+			return a < b
+		}
+		return templateString(keys[index[i]]) < templateString(keys[index[j]])
+	})
+	sorted := make([]interface{}, len(items))
+	for i, j := range index {
+		sorted[i] = items[j]
+	}
+	return sorted, nil
+}
+
+// templateGroupBy groups the items of a list by the value of a field, the groups are sorted by the value
+func templateGroupBy(field string, list interface{}) ([]TemplateGroup, error) {
+	items, err := templateList(list)
+	if err != nil {
+		return nil, err
+	}
+	groups := make(map[string]*TemplateGroup)
+	var keys []string
+	for _, item := range items {
+		value, err := templateField(item, field)
+		if err != nil {
+			return nil, err
+		}
+		key := templateString(value)
+		if _, present := groups[key]; !present {
+			groups[key] = &TemplateGroup{Key: key}
+			keys = append(keys, key)
+		}
+		groups[key].Items = append(groups[key].Items, item)
+	}
+	sort.Strings(keys)
+	out := []TemplateGroup{}
+	for _, key := range keys {
+		out = append(out, *groups[key])
+	}
+	return out, nil
+}
+
+// templateAttr returns the value of an attribute from a list of attributes, or an empty string if it is not there, e.g.
+// {{ attr "cores" .Attributes }}
+func templateAttr(name string, attributes []ResultAttribute) interface{} {
+	for _, attribute := range attributes {
+		if attribute.Name == name {
+			return attribute.Value
+		}
+	}
+	return ""
+}
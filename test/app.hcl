@@ -1,9 +1,29 @@
 solution_name    = "Testapp"
 solution_number  = "APM00001"
 
+metadata {
+  business_owner      = "Jane Smith"
+  technical_owner     = "Platform team"
+  criticality         = "tier2"
+  data_classification = "internal"
+  lifecycle           = "run"
+  cost_centre         = "CC1234"
+
+  tags = {
+    region = "apac"
+  }
+}
+
 resource "load_balancer" "lb" {
   protocol = "HTTPS"
   depends_on = [ server.ui ] 
+
+  link {
+    target    = server.ui
+    protocol  = "HTTPS"
+    port      = 443
+    direction = "outbound"
+  }
 }
 
 resource "server" "ui" {
@@ -20,11 +40,24 @@ resource "server" "ui" {
     database.db, 
     nas.cache 
   ]
+
+  link {
+    target      = nas.cache
+    protocol    = "NFS"
+    port        = 2049
+    criticality = "high"
+  }
 }
 
 
 resource "nas" "cache" {
-  type = "netapp"
+  type        = "netapp"
+  description = "Shared cache for the UI servers"
+
+  tags = {
+    environment = "prod"
+    owner       = "payments"
+  }
 }
 
 resource "database" "db" {
@@ -37,7 +70,7 @@ resource "database" "db" {
 
   sla {
     availability = "5nines"
-    RTO          = "1hr"
-    RPO          = "5mins"
+    rto          = "1hr"
+    rpo          = "5mins"
   }
 }
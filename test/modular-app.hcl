@@ -0,0 +1,29 @@
+solution_name   = "Modular test app"
+solution_number = "APM00002"
+
+module "orders" {
+  source = "./modules/dotnet-stack"
+  cores  = 4
+  db_ha  = true
+}
+
+module "reporting" {
+  source = "./modules/dotnet-stack"
+}
+
+resource "nas" "shared" {
+  type = "netapp"
+}
+
+resource "server" "batch" {
+  os      = "Windows"
+  virtual = true
+  cores   = 2
+  memory  = 8
+
+  depends_on = [
+    module.orders.database,
+    module.reporting.database,
+    nas.shared
+  ]
+}
@@ -0,0 +1,43 @@
+variable "cores" {
+  type    = number
+  default = 2
+}
+
+variable "db_ha" {
+  type    = bool
+  default = false
+}
+
+resource "load_balancer" "lb" {
+  protocol   = "HTTPS"
+  depends_on = [server.web]
+}
+
+resource "server" "web" {
+  os         = "Windows"
+  virtual    = true
+  hypervisor = "vmware"
+  arch       = "x86"
+  cores      = var.cores
+  memory     = var.cores * 4
+  role       = "active"
+
+  depends_on = [database.db]
+}
+
+resource "database" "db" {
+  type     = "MSSQL"
+  platform = "Windows"
+  arch     = "x86"
+  virtual  = true
+  ha       = var.db_ha
+  role     = "primary"
+}
+
+output "entrypoint" {
+  value = load_balancer.lb
+}
+
+output "database" {
+  value = database.db
+}
@@ -0,0 +1,66 @@
+policy_set_name = "Production"
+
+policy "prod_database_ha" {
+  description = "Production databases must be highly available with a recovery point objective"
+  severity    = "error"
+  blocking    = true
+  remediation = "Set ha = true and add an sla block with an rpo."
+
+  solution {
+    condition {
+      attribute = "lifecycle"
+      operator  = "eq"
+      value     = "run"
+    }
+  }
+
+  rule {
+    resource = "database"
+
+    condition {
+      attribute = "role"
+      operator  = "eq"
+      value     = "primary"
+    }
+
+    require {
+      attribute = "ha"
+      operator  = "eq"
+      value     = true
+    }
+
+    require {
+      attribute = "sla.rpo"
+      operator  = "defined"
+    }
+  }
+}
+
+policy "owned_storage" {
+  description = "Shared storage must have an owner"
+  remediation = "Add an owner tag."
+
+  rule {
+    resource = "nas"
+
+    require {
+      attribute = "tags.owner"
+      operator  = "defined"
+    }
+  }
+}
+
+policy "https_only" {
+  description = "Load balancers must use HTTPS"
+  severity    = "error"
+
+  rule {
+    resource = "load_balancer"
+
+    require {
+      attribute = "protocol"
+      operator  = "eq"
+      value     = "HTTPS"
+    }
+  }
+}
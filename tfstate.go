@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"gopkg.in/yaml.v3"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TFStateMapping maps Terraform resource types to resource types in the spec, the keys can use wildcards, e.g. azurerm_*
+type TFStateMapping struct {
+	Types map[string]TFStateTypeMapping `yaml:"types"`
+}
+
+// TFStateTypeMapping maps a Terraform resource type to a resource type, attributes maps attribute paths to state
+// attributes, and values sets attributes to fixed values for every resource of the type
+type TFStateTypeMapping struct {
+	Type       string                            `yaml:"type"`
+	Attributes map[string]ImportAttributeMapping `yaml:"attributes"`
+	Values     map[string]string                 `yaml:"values"`
+}
+
+// LoadTFStateMapping reads a mapping file for Terraform state
+func LoadTFStateMapping(file string) (TFStateMapping, error) {
+	var mapping TFStateMapping
+	f, err := os.Open(file)
+	if err != nil {
+		return mapping, err
+	}
+	defer f.Close()
+
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&mapping); err != nil {
+		return mapping, fmt.Errorf("cannot read mapping %s: %v", file, err)
+	}
+
+	if len(mapping.Types) == 0 {
+		return mapping, fmt.Errorf("mapping %s does not map any resource types", file)
+	}
+	for tfType, typeMapping := range mapping.Types {
+		if typeMapping.Type == "" {
+			return mapping, fmt.Errorf("resource type '%s' is not mapped to a resource type", tfType)
+		}
+		if _, err := path.Match(tfType, ""); err != nil {
+			return mapping, fmt.Errorf("resource type '%s' is not a valid pattern: %v", tfType, err)
+		}
+		for name, attribute := range typeMapping.Attributes {
+			if attribute.From == "" {
+				return mapping, fmt.Errorf("attribute '%s' of '%s' does not say which state attribute it comes from", name, tfType)
+			}
+		}
+	}
+	return mapping, nil
+}
+
+// find returns the mapping for a Terraform resource type, an exact match is used before any wildcards, and wildcards
+// are tried in name order
+func (m TFStateMapping) find(tfType string) (TFStateTypeMapping, bool) {
+	if typeMapping, present := m.Types[tfType]; present {
+		return typeMapping, true
+	}
+	var patterns []string
+	for pattern := range m.Types {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, tfType); matched {
+			return m.Types[pattern], true
+		}
+	}
+	return TFStateTypeMapping{}, false
+}
+
+// tfState is the part of a Terraform state file (version 4) which is imported
+type tfState struct {
+	Version   int               `json:"version"`
+	Resources []tfStateResource `json:"resources"`
+}
+
+type tfStateResource struct {
+	Module    string            `json:"module"`
+	Mode      string            `json:"mode"`
+	Type      string            `json:"type"`
+	Name      string            `json:"name"`
+	Instances []tfStateInstance `json:"instances"`
+}
+
+type tfStateInstance struct {
+	IndexKey     interface{}            `json:"index_key"`
+	Attributes   map[string]interface{} `json:"attributes"`
+	Dependencies []string               `json:"dependencies"`
+}
+
+// address returns the Terraform address of the resource, e.g. module.web.aws_instance.app
+func (r tfStateResource) address() string {
+	address := r.Type + "." + r.Name
+	if r.Module != "" {
+		address = r.Module + "." + address
+	}
+	return address
+}
+
+// instanceAddress returns the Terraform address of an instance of the resource, e.g. aws_instance.app[0]
+func (r tfStateResource) instanceAddress(instance tfStateInstance) string {
+	switch key := instance.IndexKey.(type) {
+	case string:
+		return fmt.Sprintf("%s[%q]", r.address(), key)
+	case float64:
+		return fmt.Sprintf("%s[%d]", r.address(), int(key))
+	}
+	return r.address()
+}
+
+// instanceName returns the name used for an instance, which includes the names of any modules and the index so that
+// it is unique in the solution, e.g. module.web.aws_instance.app[0] becomes web_app_0
+func (r tfStateResource) instanceName(instance tfStateInstance) string {
+	var parts []string
+	moduleParts := strings.Split(r.Module, ".")
+	for i := 1; i < len(moduleParts); i = i + 2 {
+		parts = append(parts, moduleParts[i])
+	}
+	parts = append(parts, r.Name)
+	if instance.IndexKey != nil {
+		parts = append(parts, importedScalar(instance.IndexKey))
+	}
+	return strings.Join(parts, "_")
+}
+
+// readTFState reads a Terraform state file
+func readTFState(filename string) (tfState, error) {
+	var state tfState
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return state, err
+	}
+	if err := json.Unmarshal(src, &state); err != nil {
+		return state, fmt.Errorf("%s is not a valid state file: %v", filename, err)
+	}
+	if state.Version != 4 {
+		return state, fmt.Errorf("%s is a version %d state file, only version 4 is supported", filename, state.Version)
+	}
+	return state, nil
+}
+
+// ImportTFState builds a solution from the managed resources in a Terraform state.  Resource types which are not in the
+// mapping are left out, and their dependencies are not followed.
+func ImportTFState(mapping TFStateMapping, state tfState, typemap map[string]map[string]string, specs map[string]map[string]AttributeSpec) ([]Resource, hcl.Diagnostics) {
+	im := newImporter(typemap, specs)
+	unmapped := make(map[string]int)
+	instances := make(map[string][]string)
+	dependencies := make(map[string][]string)
+	var order []string
+
+	for _, resource := range state.Resources {
+		if resource.Mode != "managed" {
+			continue
+		}
+		typeMapping, present := mapping.find(resource.Type)
+		if !present {
+			unmapped[resource.Type]++
+			continue
+		}
+		for _, instance := range resource.Instances {
+			id := resource.instanceAddress(instance)
+			if !im.AddResource(id, typeMapping.Type, resource.instanceName(instance), hcl.Range{}) {
+				continue
+			}
+			instances[resource.address()] = append(instances[resource.address()], id)
+			dependencies[id] = instance.Dependencies
+			order = append(order, id)
+
+			for _, name := range sortedKeys(typeMapping.Values) {
+				im.SetAttribute(id, name, typeMapping.Values[name], hcl.Range{})
+			}
+			var names []string
+			for name := range typeMapping.Attributes {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				value, present := typeMapping.Attributes[name].lookup(instance.Attributes)
+				if !present {
+					log.WithFields(log.Fields{
+						"resource":  id,
+						"attribute": typeMapping.Attributes[name].From,
+					}).Debug("State attribute is not set")
+					continue
+				}
+				im.SetAttribute(id, name, value, hcl.Range{})
+			}
+		}
+	}
+
+	var unmappedTypes []string
+	for tfType := range unmapped {
+		unmappedTypes = append(unmappedTypes, tfType)
+	}
+	sort.Strings(unmappedTypes)
+	for _, tfType := range unmappedTypes {
+		im.warn("Unmapped resource type", fmt.Sprintf("%d %s resources are not in the mapping, they are ignored.", unmapped[tfType], tfType), hcl.Range{})
+	}
+
+	// the state lists every resource an instance depends on, directly or not, so only the direct dependencies between
+	// imported resources are kept
+	edges := make(map[string][]string)
+	for _, id := range order {
+		for _, dependency := range dependencies[id] {
+			for _, target := range instances[dependency] {
+				if target != id && !containsString(edges[id], target) {
+					edges[id] = append(edges[id], target)
+				}
+			}
+		}
+	}
+	for _, id := range order {
+		for _, target := range edges[id] {
+			if !reachableThroughOthers(edges, id, target) {
+				im.AddDependency(id, target, hcl.Range{})
+			}
+		}
+	}
+
+	return im.Resources()
+}
+
+// reachableThroughOthers checks if the target can be reached from the source without using the direct edge between them
+func reachableThroughOthers(edges map[string][]string, source string, target string) bool {
+	visited := map[string]bool{source: true}
+	var stack []string
+	for _, next := range edges[source] {
+		if next != target {
+			stack = append(stack, next)
+		}
+	}
+	for len(stack) > 0 {
+		current := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if current == target {
+			return true
+		}
+		if visited[current] {
+			continue
+		}
+		visited[current] = true
+		stack = append(stack, edges[current]...)
+	}
+	return false
+}
+
+// importTFStateCommand imports a solution from a Terraform state file, and either matches it or writes it out as HCL
+func importTFStateCommand(args []string) {
+	flags := flag.NewFlagSet("design-as-code import-tfstate", flag.ExitOnError)
+	var options reportOptions
+	options.addFlags(flags)
+	mappingFile := flags.String("mapping", "tfstate-mapping.yml", "Path to the file which maps Terraform resource types and attributes to resource types and attributes.")
+	stateFile := flags.String("state", "terraform.tfstate", "Path to the Terraform state file.")
+	solutionName := flags.String("solution-name", "", "The name of the solution. (default the name of the directory with the state file)")
+	solutionNumber := flags.String("solution-number", "", "The number of the solution.")
+	outFile := flags.String("out", "", "Write the solution as HCL to this file, instead of matching it.")
+	flags.Parse(args)
+
+	options.setLogLevel()
+
+	_, typemap, specs, _ := loadSchema()
+
+	mapping, err := LoadTFStateMapping(*mappingFile)
+	if err != nil {
+		log.WithError(err).Fatal("Cannot continue")
+	}
+
+	state, err := readTFState(*stateFile)
+	if err != nil {
+		log.WithError(err).Fatal("Cannot read Terraform state")
+	}
+
+	app := Solution{solutionName: *solutionName, solutionNumber: *solutionNumber}
+	if app.solutionName == "" {
+		directory, _ := filepath.Abs(filepath.Dir(*stateFile))
+		app.solutionName = filepath.Base(directory)
+	}
+
+	resources, diags := ImportTFState(mapping, state, typemap, specs)
+	exitOnImportErrors(diags, nil)
+	log.WithFields(log.Fields{
+		"count": len(resources),
+	}).Info("Imported resources")
+
+	if *outFile != "" {
+		writeSolutionFile(*outFile, resources, app, typemap)
+		return
+	}
+
+	patterns := loadPatterns(options.patternsLibraryFile)
+	writeReports(options, []solutionReport{reportSolution(resources, app, patterns, typemap, options)})
+}
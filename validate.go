@@ -0,0 +1,393 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclparse"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// conditionOperators are the operators which can be used in a condition on an attribute of each type
+var conditionOperators = map[string][]string{
+	"string":       {"eq", "in", "lt", "lte", "gt", "gte"},
+	"enum":         {"eq", "in", "lt", "lte", "gt", "gte"},
+	"bool":         {"eq"},
+	"int":          {"eq", "in", "lt", "lte", "gt", "gte"},
+	"float":        {"eq", "lt", "lte", "gt", "gte"},
+	"list(string)": {"contains"},
+	"list(int)":    {"contains"},
+	"map(string)":  {"contains"},
+}
+
+// aggregateFunctions are the functions which can be used in an aggregate
+var aggregateFunctions = []string{"count", "sum", "avg", "min", "max", "same"}
+
+// numericOperators are the operators which compare numbers
+var numericOperators = []string{"eq", "lt", "lte", "gt", "gte"}
+
+// sourceBlock returns the i'th block of the type in a body, or nil if the source is not known.  gohcl decodes blocks in
+// the order they appear, so the decoded patterns line up with the blocks.
+func sourceBlock(body hcl.Body, blockType string, i int, labels ...string) *hcl.Block {
+	if body == nil {
+		return nil
+	}
+	content, _, _ := body.PartialContent(&hcl.BodySchema{
+		Blocks: []hcl.BlockHeaderSchema{{Type: blockType, LabelNames: labels}},
+	})
+	if i >= len(content.Blocks) {
+		return nil
+	}
+	return content.Blocks[i]
+}
+
+// sourceSubject returns the range of an attribute in a block, or of the block itself if the attribute is not set
+func sourceSubject(block *hcl.Block, name string) *hcl.Range {
+	if block == nil {
+		return nil
+	}
+	if name != "" {
+		content, _, _ := block.Body.PartialContent(&hcl.BodySchema{
+			Attributes: []hcl.AttributeSchema{{Name: name}},
+		})
+		if attribute, present := content.Attributes[name]; present {
+			return attribute.Expr.Range().Ptr()
+		}
+	}
+	return block.DefRange.Ptr()
+}
+
+func blockBody(block *hcl.Block) hcl.Body {
+	if block == nil {
+		return nil
+	}
+	return block.Body
+}
+
+// ValidatePatterns checks the patterns make sense for the spec: the resource types and attributes exist, and the
+// operators and values suit the types of the attributes.  Patterns which fail these checks decode, but never match.
+func ValidatePatterns(patterns Patterns, body hcl.Body, typemap map[string]map[string]string) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+	nested := nestedTypes(typemap)
+	names := make(map[string]bool)
+
+	for i, pattern := range patterns.PatternSet {
+		patternBlock := sourceBlock(body, "pattern", i, "pattern_name")
+		if names[pattern.PatternName] {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagWarning,
+				Summary:  "Duplicate pattern",
+				Detail:   fmt.Sprintf("There is more than one pattern called %q.", pattern.PatternName),
+				Subject:  sourceSubject(patternBlock, ""),
+			})
+		}
+		names[pattern.PatternName] = true
+
+		if len(pattern.Rules) == 0 {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagWarning,
+				Summary:  "Pattern has no rules",
+				Detail:   fmt.Sprintf("The pattern %q does not have any rules, so it does not match any resources.", pattern.PatternName),
+				Subject:  sourceSubject(patternBlock, ""),
+			})
+		}
+
+		if pattern.Solution != nil {
+			solutionBlock := sourceBlock(blockBody(patternBlock), "solution", 0)
+			for j, condition := range pattern.Solution.Conditions {
+				conditionBlock := sourceBlock(blockBody(solutionBlock), "condition", j)
+				vtype := "string"
+				if condition.Attribute != "solution_name" && condition.Attribute != "solution_number" {
+					vtype = attributeType("metadata", condition.Attribute, typemap)
+				}
+				diags = append(diags, validateCondition(condition, "metadata", vtype, conditionBlock)...)
+			}
+		}
+
+		for j, rule := range pattern.Rules {
+			ruleBlock := sourceBlock(blockBody(patternBlock), "rule", j)
+			if _, present := typemap[rule.Resource]; !present || reservedTypes[rule.Resource] || nested[rule.Resource] {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Unknown resource type",
+					Detail:   fmt.Sprintf("The rule in pattern %q is for %q, which is not a resource type in the spec.", pattern.PatternName, rule.Resource),
+					Subject:  sourceSubject(ruleBlock, "resource"),
+				})
+				continue
+			}
+
+			for k, condition := range rule.Conditions {
+				conditionBlock := sourceBlock(blockBody(ruleBlock), "condition", k)
+				diags = append(diags, validateCondition(condition, rule.Resource, attributeType(rule.Resource, condition.Attribute, typemap), conditionBlock)...)
+			}
+
+			for k, aggregate := range rule.Aggregates {
+				aggregateBlock := sourceBlock(blockBody(ruleBlock), "aggregate", k)
+				diags = append(diags, validateAggregate(aggregate, rule.Resource, typemap, aggregateBlock)...)
+			}
+
+			for k, link := range rule.Links {
+				linkBlock := sourceBlock(blockBody(ruleBlock), "link", k)
+				if _, present := typemap["link"]; !present {
+					diags = append(diags, &hcl.Diagnostic{
+						Severity: hcl.DiagError,
+						Summary:  "Links are not defined",
+						Detail:   "Rules can only check links when the spec defines link attributes.",
+						Subject:  sourceSubject(linkBlock, ""),
+					})
+					continue
+				}
+				if _, present := typemap[link.TargetType]; link.TargetType != "" && (!present || reservedTypes[link.TargetType] || nested[link.TargetType]) {
+					diags = append(diags, &hcl.Diagnostic{
+						Severity: hcl.DiagError,
+						Summary:  "Unknown resource type",
+						Detail:   fmt.Sprintf("The link target type %q is not a resource type in the spec.", link.TargetType),
+						Subject:  sourceSubject(linkBlock, "target_type"),
+					})
+				}
+				for l, condition := range link.Conditions {
+					conditionBlock := sourceBlock(blockBody(linkBlock), "condition", l)
+					vtype := typemap["link"][condition.Attribute]
+					if condition.Attribute == "target" {
+						vtype = "string"
+					}
+					diags = append(diags, validateCondition(condition, "link", vtype, conditionBlock)...)
+				}
+			}
+		}
+	}
+	return diags
+}
+
+// validateCondition checks the attribute of a condition exists, and the operator and value suit its type
+func validateCondition(condition Condition, blockType string, vtype string, block *hcl.Block) hcl.Diagnostics {
+	switch vtype {
+	case "":
+		return hcl.Diagnostics{{
+			Severity: hcl.DiagError,
+			Summary:  "Unknown attribute",
+			Detail:   fmt.Sprintf("%q is not an attribute of %s in the spec.", condition.Attribute, blockType),
+			Subject:  sourceSubject(block, "attribute"),
+		}}
+	case "block":
+		if condition.Operator == "defined" {
+			return nil
+		}
+		return hcl.Diagnostics{{
+			Severity: hcl.DiagError,
+			Summary:  "Cannot compare a block",
+			Detail:   fmt.Sprintf("%q is a block, conditions must refer to an attribute inside it, e.g. %s.name.", condition.Attribute, condition.Attribute),
+			Subject:  sourceSubject(block, "attribute"),
+		}}
+	}
+
+	if condition.Operator == "defined" {
+		return nil
+	}
+	if !containsString(conditionOperators[vtype], condition.Operator) {
+		return hcl.Diagnostics{{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid operator",
+			Detail:   fmt.Sprintf("The operator %q cannot be used with %s, which is of type %s, use defined or one of %s.", condition.Operator, condition.Attribute, vtype, strings.Join(conditionOperators[vtype], ", ")),
+			Subject:  sourceSubject(block, "operator"),
+		}}
+	}
+
+	// value is optional so defined can leave it out, every other operator needs one
+	if condition.Value == "" {
+		return hcl.Diagnostics{{
+			Severity: hcl.DiagError,
+			Summary:  "Missing required argument",
+			Detail:   fmt.Sprintf("The operator %q needs a value to compare %s with, only defined can be used without one.", condition.Operator, condition.Attribute),
+			Subject:  sourceSubject(block, "value"),
+		}}
+	}
+
+	if problem := valueProblem(vtype, condition.Operator, condition.Value); problem != "" {
+		return hcl.Diagnostics{{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid value",
+			Detail:   fmt.Sprintf("The value %q for %s %s.", condition.Value, condition.Attribute, problem),
+			Subject:  sourceSubject(block, "value"),
+		}}
+	}
+	return nil
+}
+
+// valueProblem describes why a value cannot be compared with an attribute of the type, or returns an empty string
+// if it can
+func valueProblem(vtype string, operator string, value string) string {
+	values := []string{value}
+	if operator == "in" {
+		values = splitValueList(value)
+	}
+	for _, v := range values {
+		switch vtype {
+		case "bool":
+			if v != "true" && v != "false" {
+				return "must be true or false"
+			}
+		case "int", "list(int)":
+			if _, err := strconv.Atoi(v); err != nil {
+				return "must be a whole number"
+			}
+		case "float":
+			if _, err := strconv.ParseFloat(v, 64); err != nil {
+				return "must be a number"
+			}
+		}
+	}
+	return ""
+}
+
+// validateAggregate checks the function of an aggregate exists, and that it works over a number, apart from same which
+// compares the values of any attribute and does not take an operator or value
+func validateAggregate(aggregate Aggregate, resourceType string, typemap map[string]map[string]string, block *hcl.Block) hcl.Diagnostics {
+	if !containsString(aggregateFunctions, aggregate.Function) {
+		return hcl.Diagnostics{{
+			Severity: hcl.DiagError,
+			Summary:  "Unknown aggregate function",
+			Detail:   fmt.Sprintf("%q is not an aggregate function, use one of %s.", aggregate.Function, strings.Join(aggregateFunctions, ", ")),
+			Subject:  sourceSubject(block, "function"),
+		}}
+	}
+	switch aggregate.Function {
+	case "count":
+	case "same":
+		if attributeType(resourceType, aggregate.Attribute, typemap) == "" {
+			return hcl.Diagnostics{{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid aggregate attribute",
+				Detail:   fmt.Sprintf("same needs an attribute of %s, %q is not one.", resourceType, aggregate.Attribute),
+				Subject:  sourceSubject(block, "attribute"),
+			}}
+		}
+		return nil
+	default:
+		vtype := attributeType(resourceType, aggregate.Attribute, typemap)
+		if vtype != "int" && vtype != "float" {
+			return hcl.Diagnostics{{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid aggregate attribute",
+				Detail:   fmt.Sprintf("%s needs a numeric attribute of %s, %q is not one.", aggregate.Function, resourceType, aggregate.Attribute),
+				Subject:  sourceSubject(block, "attribute"),
+			}}
+		}
+	}
+	if !containsString(numericOperators, aggregate.Operator) {
+		return hcl.Diagnostics{{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid operator",
+			Detail:   fmt.Sprintf("The operator %q cannot be used with an aggregate, use one of %s.", aggregate.Operator, strings.Join(numericOperators, ", ")),
+			Subject:  sourceSubject(block, "operator"),
+		}}
+	}
+	if problem := valueProblem("float", aggregate.Operator, aggregate.Value); problem != "" {
+		return hcl.Diagnostics{{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid value",
+			Detail:   fmt.Sprintf("The value %q for %s %s.", aggregate.Value, aggregate.Function, problem),
+			Subject:  sourceSubject(block, "value"),
+		}}
+	}
+	return nil
+}
+
+// validateCommand checks the spec, a solution and a pattern library without matching them, and exits with a non-zero
+// status if there are any errors
+func validateCommand(args []string) {
+	flags := flag.NewFlagSet("design-as-code validate", flag.ExitOnError)
+	var solutionOptions solutionOptions
+	solutionOptions.addFlags(flags)
+	specFile := flags.String("spec", defaultSpecFile, "Path to the spec.")
+	patternsLibraryFile := flags.String("patternlib", "patterns.hcl", "Path to the file containing the list of patterns to check, or an empty string to skip them.")
+	policyFile := flags.String("policies", "", "Path to a file containing policies to check.")
+	format := flags.String("format", "text", "How to write the diagnostics, 'text', 'json' or 'sarif'.")
+	debugLog := flags.Bool("debug", false, "Should we log verbose messages for debugging?")
+	flags.Parse(args)
+
+	if *debugLog {
+		log.SetLevel(log.DebugLevel)
+	}
+	if !diagnosticFormats[*format] {
+		log.WithFields(log.Fields{
+			"format": *format,
+		}).Fatal("Format is incorrect, expecting 'text', 'json' or 'sarif'")
+	}
+
+	p := hclparse.NewParser()
+	diags := validateFiles(*specFile, solutionOptions, *patternsLibraryFile, *policyFile, p)
+	exitWithDiagnostics(diags, *format, p.Files())
+}
+
+// validateFiles checks the spec, and then the solution, patterns and policies against it, the parser keeps the files
+// for the diagnostics
+func validateFiles(specFile string, options solutionOptions, patternsLibraryFile string, policyFile string, p *hclparse.Parser) hcl.Diagnostics {
+	schemas, typemap, specs, diags := readSpec(specFile)
+	if diags.HasErrors() {
+		// without a spec there is nothing to check the other files against
+		return diags
+	}
+
+	if options.solutionDescriptor != "" {
+		log.WithFields(log.Fields{
+			"file": options.solutionDescriptor,
+		}).Info("Validating solution")
+		_, _, solutionDiags := decodeSolution(p, options, schemas, typemap, specs)
+		diags = append(diags, solutionDiags...)
+	}
+
+	if patternsLibraryFile != "" {
+		log.WithFields(log.Fields{
+			"file": patternsLibraryFile,
+		}).Info("Validating patterns")
+		patterns, body, patternDiags := DecodePatternLibrary(p, patternsLibraryFile)
+		diags = append(diags, patternDiags...)
+		if !patternDiags.HasErrors() {
+			diags = append(diags, ValidatePatterns(patterns, body, typemap)...)
+		}
+	}
+
+	if policyFile != "" {
+		log.WithFields(log.Fields{
+			"file": policyFile,
+		}).Info("Validating policies")
+		policies, body, policyDiags := DecodePolicies(p, policyFile)
+		diags = append(diags, policyDiags...)
+		if !policyDiags.HasErrors() {
+			diags = append(diags, ValidatePolicies(policies, body, typemap)...)
+		}
+	}
+	sortDiagnostics(diags)
+	return diags
+}
+
+// readSpec reads a spec, any problem with it is returned as a diagnostic
+func readSpec(specFile string) (map[string]hcl.BodySchema, map[string]map[string]string, map[string]map[string]AttributeSpec, hcl.Diagnostics) {
+	schemas := make(map[string]hcl.BodySchema)
+	typemap := make(map[string]map[string]string)
+	specs := make(map[string]map[string]AttributeSpec)
+	if _, err := ReadSchema(specFile, schemas, typemap, specs); err != nil {
+		return nil, nil, nil, hcl.Diagnostics{{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid spec",
+			Detail:   fmt.Sprintf("The spec %s cannot be used: %v.", specFile, err),
+		}}
+	}
+	return schemas, typemap, specs, nil
+}
+
+// exitWithDiagnostics writes the diagnostics to stdout, and exits with a non-zero status if there are any errors
+func exitWithDiagnostics(diags hcl.Diagnostics, format string, files map[string]*hcl.File) {
+	if err := WriteDiagnostics(os.Stdout, format, diags, files); err != nil {
+		log.WithError(err).Fatal("Error writing diagnostics")
+	}
+	if diags.HasErrors() {
+		os.Exit(1)
+	}
+}
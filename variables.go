@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/ext/typeexpr"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var variableBlockSchema = &hcl.BodySchema{
+	Attributes: []hcl.AttributeSchema{
+		{
+			Name:     "default",
+			Required: false,
+		},
+		{
+			Name:     "type",
+			Required: false,
+		},
+		{
+			Name:     "description",
+			Required: false,
+		},
+	},
+}
+
+// variable is a declared input to a solution
+type variable struct {
+	name         string
+	variableType cty.Type
+	defaultValue cty.Value
+	declRange    hcl.Range
+}
+
+// DecodeVariables works out the values of the variables and locals declared in a solution, and returns an evaluation
+// context which has these available as var.<name> and local.<name> along with the standard functions.  Values for
+// variables come from the default, then the variable files in order, and then the values given on the command line.
+func DecodeVariables(body *hcl.BodyContent, options DecodeOptions) (*hcl.EvalContext, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+
+	functionCtx := &hcl.EvalContext{
+		Functions: standardFunctions(),
+	}
+
+	// read the declarations
+	declared := make(map[string]*variable)
+	for _, block := range body.Blocks.OfType("variable") {
+		name := block.Labels[0]
+		if previous, present := declared[name]; present {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Duplicate variable declaration",
+				Detail:   fmt.Sprintf("A variable named \"%s\" was already declared at %s.", name, previous.declRange),
+				Subject:  block.DefRange.Ptr(),
+			})
+			continue
+		}
+
+		content, diag := block.Body.Content(variableBlockSchema)
+		diags = append(diags, diag...)
+
+		v := &variable{
+			name:         name,
+			variableType: cty.DynamicPseudoType,
+			declRange:    block.DefRange,
+		}
+		if attribute, present := content.Attributes["type"]; present {
+			ty, diag := typeexpr.TypeConstraint(attribute.Expr)
+			diags = append(diags, diag...)
+			if !diag.HasErrors() {
+				v.variableType = ty
+			}
+		}
+		if attribute, present := content.Attributes["default"]; present {
+			val, diag := attribute.Expr.Value(functionCtx)
+			diags = append(diags, diag...)
+			if !diag.HasErrors() {
+				v.defaultValue, diag = convertVariable(v, val, attribute.Expr.Range())
+				diags = append(diags, diag...)
+			}
+		}
+		declared[name] = v
+	}
+
+	values := make(map[string]cty.Value)
+	for name, v := range declared {
+		if v.defaultValue != cty.NilVal {
+			values[name] = v.defaultValue
+		}
+	}
+
+	// then the variable files
+	for _, file := range options.VariableFiles {
+		attributes, diag := file.JustAttributes()
+		diags = append(diags, diag...)
+		for name, attribute := range attributes {
+			v, present := declared[name]
+			if !present {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Value for undeclared variable",
+					Detail:   fmt.Sprintf("The variable file sets \"%s\", but there is no variable with this name in the solution.", name),
+					Subject:  attribute.NameRange.Ptr(),
+				})
+				continue
+			}
+			val, diag := attribute.Expr.Value(functionCtx)
+			diags = append(diags, diag...)
+			if !diag.HasErrors() {
+				values[name], diag = convertVariable(v, val, attribute.Expr.Range())
+				diags = append(diags, diag...)
+			}
+		}
+	}
+
+	// and finally the command line
+	names := make([]string, 0, len(options.VariableValues))
+	for name := range options.VariableValues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		v, present := declared[name]
+		if !present {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Value for undeclared variable",
+				Detail:   fmt.Sprintf("A value was given for \"%s\" on the command line, but there is no variable with this name in the solution.", name),
+			})
+			continue
+		}
+		val, diag := parseVariableValue(v, options.VariableValues[name])
+		diags = append(diags, diag...)
+		if !diag.HasErrors() {
+			values[name], diag = convertVariable(v, val, v.declRange)
+			diags = append(diags, diag...)
+		}
+	}
+
+	// modules get their values from the module block
+	for name, input := range options.inputs {
+		v, present := declared[name]
+		if !present {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Value for undeclared variable",
+				Detail:   fmt.Sprintf("A value was given for \"%s\", but the module has no variable with this name.", name),
+				Subject:  input.subject.Ptr(),
+			})
+			continue
+		}
+		val, diag := convertVariable(v, input.value, input.subject)
+		diags = append(diags, diag...)
+		if !diag.HasErrors() {
+			values[name] = val
+		}
+	}
+
+	for name, v := range declared {
+		if _, present := values[name]; !present {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "No value for required variable",
+				Detail:   fmt.Sprintf("The variable \"%s\" has no default, so a value must be given with -var or -var-file.", name),
+				Subject:  v.declRange.Ptr(),
+			})
+		}
+	}
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	ctx := &hcl.EvalContext{
+		Variables: map[string]cty.Value{
+			"var":   cty.ObjectVal(values),
+			"local": cty.EmptyObjectVal,
+		},
+		Functions: functionCtx.Functions,
+	}
+
+	// locals can refer to each other, so keep evaluating the ones which are left until no more can be done
+	pending := make(map[string]*hcl.Attribute)
+	for _, block := range body.Blocks.OfType("locals") {
+		attributes, diag := block.Body.JustAttributes()
+		diags = append(diags, diag...)
+		for name, attribute := range attributes {
+			pending[name] = attribute
+		}
+	}
+	locals := make(map[string]cty.Value)
+	for len(pending) > 0 {
+		progress := false
+		for name, attribute := range pending {
+			val, diag := attribute.Expr.Value(ctx)
+			if diag.HasErrors() {
+				continue
+			}
+			locals[name] = val
+			delete(pending, name)
+			progress = true
+			ctx.Variables["local"] = cty.ObjectVal(locals)
+		}
+		if !progress {
+			// report the errors for whatever is left
+			for _, attribute := range pending {
+				_, diag := attribute.Expr.Value(ctx)
+				diags = append(diags, diag...)
+			}
+			break
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"variables": len(values),
+		"locals":    len(locals),
+	}).Debug("Decoded variables and locals")
+
+	return ctx, diags
+}
+
+// parseVariableValue turns a value from the command line into a cty.Value, strings are taken as they are, but for
+// other types the value is parsed as an HCL expression, e.g. -var 'ports=[80, 443]'
+func parseVariableValue(v *variable, raw string) (cty.Value, hcl.Diagnostics) {
+	if v.variableType == cty.String || v.variableType == cty.DynamicPseudoType {
+		return cty.StringVal(raw), nil
+	}
+	expr, diags := hclsyntax.ParseExpression([]byte(raw), fmt.Sprintf("<value for var.%s>", v.name), hcl.InitialPos)
+	if diags.HasErrors() {
+		return cty.NilVal, diags
+	}
+	return expr.Value(nil)
+}
+
+// convertVariable converts a value to the type of the variable
+func convertVariable(v *variable, val cty.Value, subject hcl.Range) (cty.Value, hcl.Diagnostics) {
+	converted, err := convert.Convert(val, v.variableType)
+	if err != nil {
+		return cty.NilVal, hcl.Diagnostics{
+			{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid value for variable",
+				Detail:   fmt.Sprintf("The value for \"%s\" is not suitable: %v.", v.name, err),
+				Subject:  subject.Ptr(),
+			},
+		}
+	}
+	return converted, nil
+}
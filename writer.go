@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// WriteSolution serialises a solution and its resources as canonical HCL which decodes back to the same model.  The
+// solution attributes and metadata come first, followed by the resources sorted by type and name.  Resources from
+// modules and expanded instances cannot be written, because the module or the count which made them is not in the
+// model.
+func WriteSolution(resources []Resource, solution Solution, typemap map[string]map[string]string) ([]byte, error) {
+	for _, resource := range resources {
+		if resource.resourceModule != "" {
+			return nil, fmt.Errorf("%s comes from a module, resources from modules cannot be written", resourceAddress(resource))
+		}
+		if strings.ContainsAny(resource.resourceName, "[]") {
+			return nil, fmt.Errorf("%s is an expanded instance, expanded resources cannot be written", resourceAddress(resource))
+		}
+	}
+
+	file := hclwrite.NewEmptyFile()
+	body := file.Body()
+	body.SetAttributeValue("solution_name", cty.StringVal(solution.solutionName))
+	if solution.solutionNumber != "" {
+		body.SetAttributeValue("solution_number", cty.StringVal(solution.solutionNumber))
+	}
+	if len(solution.solutionMetadata) > 0 {
+		body.AppendNewline()
+		metadata := body.AppendNewBlock("metadata", nil)
+		writeBlock(metadata.Body(), solution.solutionMetadata, "metadata", typemap)
+	}
+
+	sorted := append([]Resource{}, resources...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].resourceType != sorted[j].resourceType {
+			return sorted[i].resourceType < sorted[j].resourceType
+		}
+		return sorted[i].resourceName < sorted[j].resourceName
+	})
+
+	for _, resource := range sorted {
+		body.AppendNewline()
+		block := body.AppendNewBlock("resource", []string{resource.resourceType, resource.resourceName})
+		writeBlock(block.Body(), resource.resourceAttributes, resource.resourceType, typemap)
+		writeLinks(block.Body(), resource.resourceLinks, typemap)
+		if dependencies := resourceDependencies(resource); len(dependencies) > 0 {
+			sortedDependencies := append([]string{}, dependencies...)
+			sort.Strings(sortedDependencies)
+			block.Body().AppendNewline()
+			block.Body().SetAttributeRaw("depends_on", tokensForAddresses(sortedDependencies))
+		}
+	}
+
+	return hclwrite.Format(file.Bytes()), nil
+}
+
+// writeBlock writes the attributes of a resource, nested block, link or metadata.  The description comes first, then
+// the other attributes in name order, then tags, and then nested blocks in name order.  depends_on is written by
+// WriteSolution.
+func writeBlock(body *hclwrite.Body, attributes map[string]interface{}, blockType string, typemap map[string]map[string]string) {
+	var names, blocks []string
+	for name := range attributes {
+		switch {
+		case name == "depends_on" || name == "description" || name == "tags":
+		case typemap[blockType][name] == "block":
+			blocks = append(blocks, name)
+		default:
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	sort.Strings(blocks)
+
+	if description, present := attributes["description"]; present {
+		body.SetAttributeValue("description", valueToCty(description))
+	}
+	for _, name := range names {
+		body.SetAttributeValue(name, valueToCty(attributes[name]))
+	}
+	if tags, present := attributes["tags"]; present {
+		body.SetAttributeValue("tags", valueToCty(tags))
+	}
+	for _, name := range blocks {
+		body.AppendNewline()
+		nested := body.AppendNewBlock(name, nil)
+		writeBlock(nested.Body(), attributes[name].(map[string]interface{}), name, typemap)
+	}
+}
+
+// writeLinks writes the links of a resource as link blocks sorted by target, the target is written as a reference
+func writeLinks(body *hclwrite.Body, links []Relationship, typemap map[string]map[string]string) {
+	sorted := append([]Relationship{}, links...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].target < sorted[j].target
+	})
+	for _, link := range sorted {
+		body.AppendNewline()
+		block := body.AppendNewBlock("link", nil)
+		block.Body().SetAttributeRaw("target", tokensForAddress(link.target))
+		writeBlock(block.Body(), link.relationshipAttributes, "link", typemap)
+	}
+}
+
+// valueToCty converts a decoded attribute value back to a cty value
+func valueToCty(value interface{}) cty.Value {
+	switch v := value.(type) {
+	case string:
+		return cty.StringVal(v)
+	case bool:
+		return cty.BoolVal(v)
+	case int:
+		return cty.NumberIntVal(int64(v))
+	case float64:
+		return cty.NumberFloatVal(v)
+	case []string:
+		if len(v) == 0 {
+			return cty.ListValEmpty(cty.String)
+		}
+		var list []cty.Value
+		for _, item := range v {
+			list = append(list, cty.StringVal(item))
+		}
+		return cty.ListVal(list)
+	case []int:
+		if len(v) == 0 {
+			return cty.ListValEmpty(cty.Number)
+		}
+		var list []cty.Value
+		for _, item := range v {
+			list = append(list, cty.NumberIntVal(int64(item)))
+		}
+		return cty.ListVal(list)
+	case map[string]string:
+		if len(v) == 0 {
+			return cty.MapValEmpty(cty.String)
+		}
+		m := make(map[string]cty.Value)
+		for key, item := range v {
+			m[key] = cty.StringVal(item)
+		}
+		return cty.MapVal(m)
+	}
+	return cty.NullVal(cty.DynamicPseudoType)
+}
+
+// tokensForAddress writes a resource address as a reference, e.g. server.ui
+func tokensForAddress(address string) hclwrite.Tokens {
+	traversal, diags := hclsyntax.ParseTraversalAbs([]byte(address), "", hcl.InitialPos)
+	if diags.HasErrors() {
+		// not a valid reference, so write it as a string and let the decoder report it
+		return hclwrite.TokensForValue(cty.StringVal(address))
+	}
+	return hclwrite.TokensForTraversal(traversal)
+}
+
+// tokensForAddresses writes a list of resource addresses as references, with one per line
+func tokensForAddresses(addresses []string) hclwrite.Tokens {
+	tokens := hclwrite.Tokens{
+		{Type: hclsyntax.TokenOBrack, Bytes: []byte("[")},
+		{Type: hclsyntax.TokenNewline, Bytes: []byte("\n")},
+	}
+	for _, address := range addresses {
+		tokens = append(tokens, tokensForAddress(address)...)
+		tokens = append(tokens,
+			&hclwrite.Token{Type: hclsyntax.TokenComma, Bytes: []byte(",")},
+			&hclwrite.Token{Type: hclsyntax.TokenNewline, Bytes: []byte("\n")},
+		)
+	}
+	return append(tokens, &hclwrite.Token{Type: hclsyntax.TokenCBrack, Bytes: []byte("]")})
+}